@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+* /v2/ 接口：请求及响应均为json，使用正确的HTTP状态码，
+* 推送接口为每个token返回分配的消息ID以及是否被接受。
+ */
+
+const (
+	TOKEN_STATUS_ACCEPTED = "accepted"
+	TOKEN_STATUS_REJECTED = "rejected"
+)
+
+type TokenResult struct {
+	Token  string           `json:"token"`
+	ID     string           `json:"id,omitempty"` // 消息ID，即apns-id
+	Status string           `json:"status"`
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+type PushResult struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []*TokenResult `json:"results"`
+	Shrink   *ShrinkResult  `json:"shrink,omitempty"`
+}
+
+func registerApiV2() {
+	http.HandleFunc("/v2/push", pushHandlerV2)
+	http.HandleFunc("/v2/recover_token", recoverHandlerV2)
+	http.HandleFunc("/v2/devices", devicesHandler)
+	http.HandleFunc("/v2/messages", messagesHandler)
+	http.HandleFunc("/v2/messages/", messagesHandler)
+	http.HandleFunc("/v2/apps/", appsHandler)
+	http.HandleFunc("/v2/admin/archive", archiveHandler)
+	http.HandleFunc("/v2/admin/feedback", feedbackHandler)
+	http.HandleFunc("/v2/admin/certificates", certificatesHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Println("can not encode response", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"errors":[{"message":"can not encode response"}]}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]interface{}{"errors": ValidationErrors{{Message: message}}})
+}
+
+/**
+读取json格式的请求体，出错时已写好响应，返回nil。
+*/
+func readJsonBody(w http.ResponseWriter, request *http.Request) map[string]interface{} {
+	if request.Method != "POST" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "read request body fail")
+		return nil
+	}
+	var dict map[string]interface{}
+	if err = json.Unmarshal(body, &dict); err != nil || dict == nil {
+		writeApiError(w, http.StatusBadRequest, "request body should be a json object")
+		return nil
+	}
+	return dict
+}
+
+/**
+从请求中读取app，sandbox时加上后缀，并确认该应用存在。出错时已写好响应，返回空字符串。
+*/
+func appFromMap(w http.ResponseWriter, dict map[string]interface{}) string {
+	app := appKeyFromMap(w, dict)
+	if len(app) == 0 {
+		return ""
+	}
+	if problem := certificateProblem(app); len(problem) != 0 {
+		writeApiError(w, http.StatusServiceUnavailable, "app is unhealthy: "+problem)
+		return ""
+	}
+	if getPool(app) == nil {
+		writeApiError(w, http.StatusNotFound, "unknown app "+app)
+		return ""
+	}
+	if problem := appUnavailable(app); len(problem) != 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(circuitRetryAfter(app)))
+		writeApiError(w, http.StatusServiceUnavailable, "app is unavailable: "+problem)
+		return ""
+	}
+	return app
+}
+
+/**
+请求中的app及sandbox对应的连接池key，缺少app时写入错误并返回空字符串。
+*/
+func appKeyFromMap(w http.ResponseWriter, dict map[string]interface{}) string {
+	app, ok := dict["app"].(string)
+	if !ok || len(app) == 0 {
+		writeValidationErrors(w, ValidationErrors{{"app", RULE_REQUIRED, 0, "app is required"}})
+		return ""
+	}
+	if sb, ok := dict["sandbox"].(bool); ok && sb {
+		app = app + DEVELOP_SUBFIX
+	}
+	return app
+}
+
+/**
+只管理token而不发送消息的接口用，只要求应用存在，证书有问题或熔断时也可以调用。
+*/
+func knownAppFromMap(w http.ResponseWriter, dict map[string]interface{}) string {
+	app := appKeyFromMap(w, dict)
+	if len(app) == 0 {
+		return ""
+	}
+	if !isKnownApp(app) {
+		writeApiError(w, http.StatusNotFound, "unknown app "+app)
+		return ""
+	}
+	return app
+}
+
+/**
+应用相关的接口，路径为/v2/apps/<app>/<action>。
+*/
+func appsHandler(w http.ResponseWriter, request *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/v2/apps/"), "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	app, action := parts[0], strings.Trim(parts[1], "/")
+	if getPool(app) == nil && getPool(app+DEVELOP_SUBFIX) == nil {
+		writeApiError(w, http.StatusNotFound, "unknown app "+app)
+		return
+	}
+	switch action {
+	case "webhooks/test":
+		webhookTestHandler(w, request, app)
+	case "invalid-tokens":
+		invalidTokensHandler(w, request, app)
+	default:
+		writeApiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/**
+推送消息，参数与/push相同。
+- 200：至少有一个token被接受，每个token的结果见results
+- 400：请求格式或payload有误，或所有token都被拒绝
+- 404：应用不存在
+- 503：服务器正在关闭
+*/
+func pushHandlerV2(w http.ResponseWriter, request *http.Request) {
+	if shutingDown.Load() {
+		writeApiError(w, http.StatusServiceUnavailable, "server maintaining... please try later")
+		return
+	}
+	dict := readJsonBody(w, request)
+	if dict == nil {
+		return
+	}
+	app := appFromMap(w, dict)
+	if len(app) == 0 {
+		return
+	}
+
+	template, shrinkResult, err := MakeNotificationTemplate(dict, app)
+	if err != nil {
+		writeValidationErrors(w, err)
+		return
+	}
+	fields, tokens, tokenErr := tokensFromMap(dict)
+	if tokenErr != nil {
+		writeValidationErrors(w, ValidationErrors{tokenErr})
+		return
+	}
+
+	result := &PushResult{Results: make([]*TokenResult, len(tokens))}
+	busy := false
+	if shrinkResult.Applied() {
+		result.Shrink = shrinkResult
+	}
+	for i, token := range tokens {
+		tokenStr, _ := token.(string)
+		message, err := template.ForToken(fields[i], token, len(tokens))
+		if err != nil {
+			result.Results[i] = &TokenResult{Token: tokenStr, Status: TOKEN_STATUS_REJECTED, Errors: ValidationErrors{err}}
+			result.Rejected++
+			continue
+		}
+		RecordStatus(message, STATUS_ACCEPTED, 0, "")
+		if err := Notify(message); err != nil {
+			result.Results[i] = &TokenResult{Token: tokenStr, ID: message.ApnsID, Status: TOKEN_STATUS_REJECTED,
+				Errors: ValidationErrors{{Message: err.Error()}}}
+			result.Rejected++
+			busy = true
+			continue
+		}
+		result.Results[i] = &TokenResult{Token: tokenStr, ID: message.ApnsID, Status: TOKEN_STATUS_ACCEPTED}
+		result.Accepted++
+	}
+
+	status := http.StatusOK
+	if result.Accepted == 0 && busy {
+		// 发送队列满了，稍后重试
+		w.Header().Set("Retry-After", "1")
+		status = http.StatusServiceUnavailable
+	} else if result.Accepted == 0 {
+		status = http.StatusBadRequest
+	}
+	writeJson(w, status, result)
+}
+
+/**
+把token从bad token集合中移除，参数：app、token、sandbox。
+*/
+func recoverHandlerV2(w http.ResponseWriter, request *http.Request) {
+	dict := readJsonBody(w, request)
+	if dict == nil {
+		return
+	}
+	app := knownAppFromMap(w, dict)
+	if len(app) == 0 {
+		return
+	}
+	token, ok := dict["token"].(string)
+	if !ok || len(token) == 0 {
+		writeValidationErrors(w, ValidationErrors{{"token", RULE_REQUIRED, 0, "token is required"}})
+		return
+	}
+	token = normalizeToken(token)
+	recoverToken(app, token)
+	writeJson(w, http.StatusOK, map[string]interface{}{"app": app, "token": token, "status": "recovered"})
+}
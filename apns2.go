@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+* 基于HTTP/2的Provider API。每条消息是一个独立的POST请求，
+* 苹果对每个请求单独返回结果，失败时body里带有JSON格式的错误原因。
+ */
+
+type http2ErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+/**
+创建HTTP/2通道的连接信息。HTTP/2的client会自行建立和复用底层连接，
+这里不主动拨号，第一次推送时才会真正连接服务器。
+*/
+func connectHttp2(app string, config *tls.Config, sandbox bool) *ConnectInfo {
+	endPoint := appConfig.Http2Endpoint
+	if sandbox {
+		endPoint = appConfig.Http2SandboxEndpoint
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   config,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   time.Duration(appConfig.ConnectionIdleSecs) * time.Second,
+		},
+		Timeout: 30 * time.Second,
+	}
+	log.Println("http2 client is ready for ", endPoint)
+	if sandbox {
+		app = app + DEVELOP_SUBFIX
+	}
+	return &ConnectInfo{
+		Client:       client,
+		Endpoint:     strings.TrimSuffix(endPoint, "/"),
+		Transport:    TRANSPORT_HTTP2,
+		App:          app,
+		Sandbox:      sandbox,
+		lastActivity: time.Now().Unix(),
+	}
+}
+
+/**
+发送一条消息，苹果的响应交给responseCN处理。消息无法发送（缺少token、payload有误、签发provider token失败）时返回错误。
+*/
+func pushMessageHttp2(info *ConnectInfo, client *http.Client, identity int32, message *Notification) error {
+	if len(message.Token) == 0 {
+		return errors.New("missing token")
+	}
+
+	if message.Payload == nil || message.Payload.IsEmpty() {
+		return errors.New("not a valid payload")
+	}
+
+	payloadBytes, err := message.Payload.Json()
+	if err != nil {
+		return fmt.Errorf("json marshal error %s", err)
+	}
+
+	url := fmt.Sprintf("%s/3/device/%s", info.Endpoint, message.Token)
+	request, err := http.NewRequest("POST", url, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("fail to build http2 request %s", err)
+	}
+	request.Header.Set("apns-topic", message.TopicValue())
+	request.Header.Set("apns-expiration", strconv.FormatInt(message.ExpiryTime(), 10))
+	request.Header.Set("apns-priority", strconv.Itoa(message.PriorityValue()))
+	if len(message.PushType) != 0 {
+		request.Header.Set("apns-push-type", message.PushType)
+	}
+	if len(message.CollapseID) != 0 {
+		request.Header.Set("apns-collapse-id", message.CollapseID)
+	}
+	if len(message.ApnsID) != 0 {
+		request.Header.Set("apns-id", message.ApnsID)
+	}
+
+	providerToken := ""
+	if info.signer != nil {
+		providerToken, err = info.signer.Token()
+		if err != nil {
+			return fmt.Errorf("fail to sign provider token %s", err)
+		}
+		request.Header.Set("authorization", "bearer "+providerToken)
+	}
+
+	rsp, err := client.Do(request)
+	if err != nil {
+		err = describeTLSError(err)
+		log.Printf("error when post to %s, %s", info.Endpoint, err)
+		responseCN <- &APNSRespone{
+			Command:      8,
+			Status:       APNS_ERROR_PROCESSING_ERROR,
+			Identifier:   identity,
+			App:          info.App,
+			Sandbox:      info.Sandbox,
+			Transport:    TRANSPORT_HTTP2,
+			Reason:       err.Error(),
+			sequence:     info.sequence,
+			Notification: message,
+		}
+		return nil
+	}
+	defer rsp.Body.Close()
+	connectSucceeded(info.App, info.slot)
+
+	if rsp.StatusCode == http.StatusOK {
+		log.Printf("apns accept message %d, apns-id %s", identity, rsp.Header.Get("apns-id"))
+		RecordStatus(message, STATUS_SENT, rsp.StatusCode, "")
+		return nil
+	}
+
+	var result http2ErrorResponse
+	body, _ := ioutil.ReadAll(rsp.Body)
+	if err = json.Unmarshal(body, &result); err != nil {
+		log.Printf("can not decode apns response %s: %s", string(body), err)
+	}
+	responseCN <- &APNSRespone{
+		Command:       8,
+		Status:        http2ReasonStatus(result.Reason),
+		Identifier:    identity,
+		App:           info.App,
+		Sandbox:       info.Sandbox,
+		Transport:     TRANSPORT_HTTP2,
+		HttpStatus:    rsp.StatusCode,
+		Reason:        result.Reason,
+		Timestamp:     result.Timestamp,
+		sequence:      info.sequence,
+		Notification:  message,
+		providerToken: providerToken,
+	}
+	return nil
+}
+
+/**
+稍后重发一条消息，间隔随重试次数翻倍，超过HTTP2_MAX_RETRIES次后丢弃。
+*/
+func retryHttp2Message(err *APNSRespone) {
+	message := err.Notification
+	if message == nil {
+		return
+	}
+	message.Retries++
+	if message.Retries > HTTP2_MAX_RETRIES {
+		log.Printf("drop message %s after %d retries: %s", message.ApnsID, HTTP2_MAX_RETRIES, err.Reason)
+		RecordStatus(message, STATUS_DROPPED, err.HttpStatus, err.Reason)
+		fireRejectedWebhook(message, err.HttpStatus, err.Reason, false)
+		return
+	}
+	RecordStatus(message, STATUS_REPLAYED, err.HttpStatus, err.Reason)
+	delay := backoffDelay(message.Retries)
+	log.Printf("retry message %s in %s", message.ApnsID, delay)
+	time.AfterFunc(delay, func() {
+		if e := Notify(message); e != nil {
+			log.Printf("can not retry message %s: %s", message.ApnsID, e)
+		}
+	})
+}
+
+/**
+把HTTP/2的错误原因映射为二进制协议的错误码，以便沿用原有的错误处理流程。
+*/
+func http2ReasonStatus(reason string) byte {
+	switch reason {
+	case "MissingDeviceToken":
+		return APNS_ERROR_MISSING_DEVICE_TOKEN
+	case "MissingTopic":
+		return APNS_ERROR_MISSING_TOPIC
+	case "PayloadEmpty":
+		return APNS_ERROR_MISSING_PAYLOAD
+	case "BadTopic", "TopicDisallowed", "DeviceTokenNotForTopic":
+		return APNS_ERROR_INVALID_TOPIC_SIZE
+	case "PayloadTooLarge":
+		return APNS_ERROR_INVALID_PAYLOAD_SIZE
+	case "BadDeviceToken", "Unregistered":
+		return APNS_ERROR_INVALID_TOKEN
+	case "InternalServerError":
+		return APNS_ERROR_PROCESSING_ERROR
+	case "Shutdown", "ServiceUnavailable":
+		return APNS_ERROR_SHUTDOWN
+	case "ExpiredProviderToken":
+		return APNS_ERROR_EXPIRED_PROVIDER_TOKEN
+	case "InvalidProviderToken", "MissingProviderToken":
+		return APNS_ERROR_INVALID_PROVIDER_TOKEN
+	case "TooManyRequests", "TooManyProviderTokenUpdates":
+		return APNS_ERROR_TOO_MANY_REQUESTS
+	}
+	return APNS_ERROR_NONE
+}
+
+/**
+处理HTTP/2通道的错误。HTTP/2的每条消息相互独立，被拒绝的消息不影响其他消息。
+provider token过期、限流（429）及服务器出错（5xx）时该消息稍后重发；
+请求没发出去或苹果要求断开（Shutdown）时才需要重建client。
+*/
+func handleHttp2Error(err *APNSRespone) {
+	LogError(err.Status, err.Identifier)
+	log.Printf("http2 status %d, reason %s", err.HttpStatus, err.Reason)
+
+	if err.Status == APNS_ERROR_EXPIRED_PROVIDER_TOKEN {
+		// token过期，重新签发后再发。时钟或密钥有问题时每次都会过期，重试次数有限。
+		if info := findConnection(err); info != nil && info.signer != nil {
+			info.signer.Expire(err.providerToken)
+		}
+		retryHttp2Message(err)
+		return
+	}
+	if err.HttpStatus == http.StatusTooManyRequests || err.HttpStatus >= http.StatusInternalServerError {
+		retryHttp2Message(err)
+		if err.Status == APNS_ERROR_SHUTDOWN {
+			if info := findConnection(err); info != nil {
+				go info.Reconnect()
+			}
+		}
+		return
+	}
+
+	if err.HttpStatus != 0 {
+		RecordStatus(err.Notification, STATUS_REJECTED, err.HttpStatus, err.Reason)
+		invalid := false
+		if err.Status == APNS_ERROR_INVALID_TOKEN && err.Notification != nil {
+			// 410时以苹果给出的时间为失效时间，否则以当前时间为准。
+			invalidAt := time.Now().Unix()
+			if err.Timestamp > 0 {
+				invalidAt = err.Timestamp / 1000
+			}
+			invalid = markBadToken(err.Notification.App, err.Notification.Token, invalidAt)
+		}
+		fireRejectedWebhook(err.Notification, err.HttpStatus, err.Reason, invalid)
+		return
+	}
+
+	if err.Notification != nil {
+		RecordStatus(err.Notification, STATUS_REPLAYED, err.HttpStatus, err.Reason)
+		AddErrorMessage(err.Notification)
+	}
+	info := findConnection(err)
+	if info == nil {
+		return
+	}
+	// 请求没发出去，关闭client后按退避重连。同一个client上同时失败的请求只处理一次。
+	if info.Disconnect() {
+		connectFailed(err.App, err.Sandbox, info.slot, errors.New(err.Reason))
+	}
+}
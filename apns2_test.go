@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttp2ReasonStatus(t *testing.T) {
+	for reason, status := range map[string]byte{
+		"BadDeviceToken":       APNS_ERROR_INVALID_TOKEN,
+		"Unregistered":         APNS_ERROR_INVALID_TOKEN,
+		"Shutdown":             APNS_ERROR_SHUTDOWN,
+		"ExpiredProviderToken": APNS_ERROR_EXPIRED_PROVIDER_TOKEN,
+		"InvalidProviderToken": APNS_ERROR_INVALID_PROVIDER_TOKEN,
+		"TooManyRequests":      APNS_ERROR_TOO_MANY_REQUESTS,
+		"SomethingNew":         APNS_ERROR_NONE,
+	} {
+		if got := http2ReasonStatus(reason); got != status {
+			t.Errorf("%s is mapped to %d, want %d", reason, got, status)
+		}
+	}
+}
+
+func TestHttp2RetryLimit(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+	ensurePool("com.a", false)
+	defer removePool("com.a")
+	defer removeErrorBucket("com.a")
+
+	message := &Notification{App: "com.a", Token: strings.Repeat("a", 64), ApnsID: NewUUID(),
+		Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}
+	handleHttp2Error(&APNSRespone{App: "com.a", Transport: TRANSPORT_HTTP2, HttpStatus: http.StatusTooManyRequests,
+		Status: http2ReasonStatus("TooManyRequests"), Reason: "TooManyRequests", Notification: message})
+	if status := getMessageStatus(message.ApnsID); status == nil || status.Status != STATUS_REPLAYED || message.Retries != 1 {
+		t.Fatalf("429 is not retried: %+v", status)
+	}
+	// 重发的消息在没有连接时进入等待队列
+	waitFor(t, "message is retried", func() bool { return HasPendingMessage("com.a") })
+
+	message.Retries = HTTP2_MAX_RETRIES
+	handleHttp2Error(&APNSRespone{App: "com.a", Transport: TRANSPORT_HTTP2, HttpStatus: http.StatusForbidden,
+		Status: http2ReasonStatus("ExpiredProviderToken"), Reason: "ExpiredProviderToken", Notification: message})
+	if status := getMessageStatus(message.ApnsID); status == nil || status.Status != STATUS_DROPPED {
+		t.Fatalf("message is not dropped after %d retries: %+v", HTTP2_MAX_RETRIES, status)
+	}
+}
+
+func TestPushMessageHttp2(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+
+	requests := make(chan *http.Request, 2)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		if strings.HasSuffix(r.URL.Path, "/bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+			return
+		}
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	appConfig.Http2Endpoint = srv.URL
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := connectHttp2("com.a", srv.Client().Transport.(*http.Transport).TLSClientConfig, false)
+	info.signer = &TokenSigner{TeamID: "TEAM", KeyID: "KEY", key: key}
+	payload := &Payload{Aps: &AlertInfo{Alert: "hi"}}
+
+	message := &Notification{App: "com.a", Token: "good", ApnsID: NewUUID(), Payload: payload, PushType: PUSH_TYPE_ALERT}
+	pushMessageHttp2(info, info.Client, 1, message)
+	request := <-requests
+	if request.ProtoMajor != 2 || request.URL.Path != "/3/device/good" {
+		t.Fatalf("%s %s", request.Proto, request.URL.Path)
+	}
+	for header, want := range map[string]string{
+		"apns-topic": "com.a", "apns-push-type": PUSH_TYPE_ALERT, "apns-priority": "10", "apns-id": message.ApnsID} {
+		if got := request.Header.Get(header); got != want {
+			t.Errorf("%s is %s, want %s", header, got, want)
+		}
+	}
+	if !strings.HasPrefix(request.Header.Get("authorization"), "bearer ") {
+		t.Errorf("authorization is %s", request.Header.Get("authorization"))
+	}
+	if status := getMessageStatus(message.ApnsID); status == nil || status.Status != STATUS_SENT {
+		t.Errorf("accepted message is %+v", status)
+	}
+
+	pushMessageHttp2(info, info.Client, 2, &Notification{App: "com.a", Token: "bad", Payload: payload})
+	<-requests
+	select {
+	case rsp := <-responseCN:
+		if rsp.Identifier != 2 || rsp.HttpStatus != http.StatusBadRequest || rsp.Status != APNS_ERROR_INVALID_TOKEN ||
+			rsp.Reason != "BadDeviceToken" || rsp.Transport != TRANSPORT_HTTP2 {
+			t.Errorf("response is %+v", rsp)
+		}
+	default:
+		t.Fatal("rejection is not reported")
+	}
+
+	if err := pushMessageHttp2(info, info.Client, 3, &Notification{App: "com.a", Payload: payload}); err == nil {
+		t.Error("message without token is sent")
+	}
+}
@@ -53,7 +53,6 @@ func main() {
 
 	Initialize(configFile)
 
-	go GenerateIdentity()
 	// 创建连接。
 	err := MakeSocket()
 	if err != nil {
@@ -66,9 +65,17 @@ func main() {
 
 	go StartFeedbackService()
 
+	go StartWebhookService()
+
+	go StartCompactService()
+
+	go StartCertificateService()
+
 	// 监听新应用或移除应用
+	go StartReloadService()
 
 	log.Print("Just wait for the channels")
+	waited := 0 // 收到信号后等待的秒数
 	signalCN := make(chan os.Signal, 1)
 	signal.Notify(signalCN, syscall.SIGTERM, syscall.SIGINT,
 		syscall.SIGHUP, syscall.SIGQUIT)
@@ -77,39 +84,77 @@ func main() {
 		case info := <-socketCN: // 一条通向APNS的socket连接完成！
 			log.Printf("socket for %s created!\n", info.App)
 			go SocketConnected(info)
-		case message := <-messageCN: // 收到一条要推送的消息！
-			go Notify(message)
-			if shutingDown {
-				log.Println("new message come during shutdown time, reset counter")
-				countDownTime = 1
-			}
 		case rsp := <-responseCN: // 收到一条来自APNS的错误通知
 			log.Printf("got apns erro response for %s\n", rsp.App)
 			go HandleError(rsp)
 		case _ = <-signalCN: // 收到系统信号，要关闭服务器
 			log.Println("got interupt or kill signal")
-			shutingDown = true
+			shutingDown.Store(true)
 			if countDownTime == 0 {
 				log.Println("count down not start, start it")
 				countDownTime = 1
 				go countDown()
 			}
 		case _ = <-countDownCN: // 收到倒数
-			countDownTime += 1
+			waited += 1
+			if pending := pendingMessages(); pending > 0 && waited < SHUTDOWN_MAX_WAIT_TIME {
+				log.Printf("%d messages are not sent yet, reset counter", pending)
+				countDownTime = 1
+			} else {
+				countDownTime += 1
+			}
 		}
 
-		if shutingDown && countDownTime >= SHUTDOWN_COUNTDOWN_TIME {
+		if shutingDown.Load() && countDownTime >= SHUTDOWN_COUNTDOWN_TIME {
 			log.Println("count down finish, no more new message, shutdown server")
-			// 关闭sockets
-			for _, info := range sockets {
-				info.Connection.Close()
-			}
+			shutdown()
 			break
 		}
 	}
 	log.Print("Bye！server shutdonw gracefully!!")
 }
 
+/**
+所有应用排队、正在发送及等待重发的消息数。
+*/
+func pendingMessages() int {
+	count := 0
+	for _, pool := range allPools() {
+		count += pool.Inflight()
+	}
+	errorBucketsMutex.Lock()
+	defer errorBucketsMutex.Unlock()
+	for _, bucket := range errorBuckets {
+		count += bucket.Len()
+	}
+	return count
+}
+
+/**
+关闭所有连接，等写消息的goroutine把没发出去的消息放回ErrorBucket并退出，
+再把这些消息放回Redis队列，最后关闭存储。
+*/
+func shutdown() {
+	poolsClosed.Store(true)
+	pools := allPools()
+	for _, pool := range pools {
+		pool.Close()
+	}
+	for _, pool := range pools {
+		pool.Wait()
+	}
+	errorBucketsMutex.Lock()
+	buckets := make([]*ErrorBucket, 0, len(errorBuckets))
+	for _, bucket := range errorBuckets {
+		buckets = append(buckets, bucket)
+	}
+	errorBucketsMutex.Unlock()
+	for _, bucket := range buckets {
+		requeueToRedis(bucket.App, bucket.TakeAll(), "server shutdown")
+	}
+	closeStore()
+}
+
 func countDown() {
 	tick := time.NewTicker(1 * time.Second)
 	for {
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+* 消息存档的保留及清理。存档只用于连接出错时重发，出错的响应在发送后很快就会返回，
+* 所以超过保留时长或超出每个应用保留条数的消息可以安全删除。消息的投递记录按同样的规则清理。
+* 无论如何配置，ARCHIVE_MIN_AGE_SECS之内的消息都不会被删除，以免影响重发。
+ */
+
+const ARCHIVE_MIN_AGE_SECS = 300
+
+/**
+* 存档中的一条消息
+ */
+type ArchivedMessage struct {
+	StoredAt     int64 // unix时间戳，秒。升级前存档的消息为0
+	Notification *Notification
+
+	ConnectNum int32
+	ID         int32
+	Size       int // 存档占用的字节数
+}
+
+type archiveRecord struct {
+	StoredAt     int64
+	Notification *Notification
+}
+
+func init() {
+	// payload中interface{}字段可能存放的类型，gob要先注册才能编码
+	gob.Register(AlertObject{})
+	gob.Register(SoundObject{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+func encodeArchive(notification *Notification) []byte {
+	var body bytes.Buffer
+	enc := gob.NewEncoder(&body)
+	if err := enc.Encode(&archiveRecord{time.Now().Unix(), notification}); err != nil {
+		log.Println("can not encode notification", err)
+		return nil
+	}
+	return body.Bytes()
+}
+
+/**
+解码存档，兼容升级前直接存放Notification的格式。
+*/
+func decodeArchive(data []byte) *ArchivedMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	var record archiveRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err == nil && record.Notification != nil {
+		return &ArchivedMessage{StoredAt: record.StoredAt, Notification: record.Notification, Size: len(data)}
+	}
+	var notification Notification
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&notification); err != nil {
+		log.Println("can not decode notification from archive", err)
+		return nil
+	}
+	return &ArchivedMessage{Notification: &notification, Size: len(data)}
+}
+
+/**
+遍历app的存档，key的格式为<prefix><app>_<connectNum>_<msgID>。
+sandbox应用的key（app_dev_...）也以app_开头，解析不出数字的key会被跳过。
+*/
+func scanArchive(scan func(prefix string, fn func(key string, value []byte) bool), prefix string,
+	app string, fn func(message *ArchivedMessage) bool) {
+	keyPrefix := prefix + app + "_"
+	scan(keyPrefix, func(key string, value []byte) bool {
+		parts := strings.Split(strings.TrimPrefix(key, keyPrefix), "_")
+		if len(parts) != 2 {
+			return true
+		}
+		connectNum, err1 := strconv.ParseInt(parts[0], 10, 32)
+		msgID, err2 := strconv.ParseInt(parts[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			return true
+		}
+		message := decodeArchive(value)
+		if message == nil {
+			message = &ArchivedMessage{Size: len(value)}
+		}
+		message.ConnectNum = int32(connectNum)
+		message.ID = int32(msgID)
+		return fn(message)
+	})
+}
+
+/**
+从<prefix><app>_<connectNum>_<msgID>格式的key中解析出存档中出现过的应用，其他记录（key中带":"）及计数器被跳过。
+*/
+func archivedApps(scan func(prefix string, fn func(key string, value []byte) bool), prefix string) []string {
+	seen := make(map[string]bool)
+	var apps []string
+	scan(prefix, func(key string, value []byte) bool {
+		key = strings.TrimPrefix(key, prefix)
+		if strings.Contains(key, ":") {
+			return true
+		}
+		parts := strings.Split(key, "_")
+		if len(parts) < 3 {
+			return true
+		}
+		_, err1 := strconv.ParseInt(parts[len(parts)-2], 10, 32)
+		_, err2 := strconv.ParseInt(parts[len(parts)-1], 10, 32)
+		if err1 != nil || err2 != nil {
+			return true
+		}
+		app := strings.Join(parts[:len(parts)-2], "_")
+		if !seen[app] {
+			seen[app] = true
+			apps = append(apps, app)
+		}
+		return true
+	})
+	return apps
+}
+
+type ArchiveStats struct {
+	App      string `json:"app"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+	Oldest   int64  `json:"oldest,omitempty"` // 最早一条消息的存档时间
+}
+
+/**
+早于cutoff的记录超过了保留时长，晚于protected的记录无论如何都不删除。
+*/
+func archiveCutoff(now time.Time) (cutoff int64, protected int64) {
+	maxAge := appConfig.ArchiveMaxAgeSecs
+	if maxAge < ARCHIVE_MIN_AGE_SECS {
+		maxAge = ARCHIVE_MIN_AGE_SECS
+	}
+	return now.Unix() - maxAge, now.Unix() - ARCHIVE_MIN_AGE_SECS
+}
+
+/**
+超出每个应用保留条数的记录数。
+*/
+func archiveOverflow(count int) int {
+	if appConfig.ArchiveMaxPerApp > 0 && count > int(appConfig.ArchiveMaxPerApp) {
+		return count - int(appConfig.ArchiveMaxPerApp)
+	}
+	return 0
+}
+
+/**
+清理一个应用的存档：删除超过保留时长的消息，再按存档时间从旧到新删除超出条数限制的消息。
+返回删除的条数及清理后的统计。
+*/
+func compactArchive(app string, now time.Time) (int, *ArchiveStats) {
+	cutoff, protected := archiveCutoff(now)
+
+	var messages []*ArchivedMessage
+	getStore().ScanMessages(app, func(message *ArchivedMessage) bool {
+		messages = append(messages, message)
+		return true
+	})
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].StoredAt < messages[j].StoredAt })
+
+	over := archiveOverflow(len(messages))
+	removed := 0
+	stats := &ArchiveStats{App: app}
+	for i, message := range messages {
+		if message.StoredAt < protected && (message.StoredAt < cutoff || i < over) {
+			getStore().DeleteMessage(app, message.ConnectNum, message.ID)
+			removed++
+			continue
+		}
+		stats.add(message)
+	}
+	return removed, stats
+}
+
+func (stats *ArchiveStats) add(message *ArchivedMessage) {
+	stats.Messages++
+	stats.Bytes += int64(message.Size)
+	if stats.Oldest == 0 || (message.StoredAt != 0 && message.StoredAt < stats.Oldest) {
+		stats.Oldest = message.StoredAt
+	}
+}
+
+func getArchiveStats(app string) *ArchiveStats {
+	stats := &ArchiveStats{App: app}
+	getStore().ScanMessages(app, func(message *ArchivedMessage) bool {
+		stats.add(message)
+		return true
+	})
+	return stats
+}
+
+/**
+当前的应用及存档、投递记录中出现过的应用，包括sandbox应用及已移除的应用。
+*/
+func archiveApps() []string {
+	seen := make(map[string]bool)
+	for _, app := range poolKeys() {
+		seen[app] = true
+	}
+	for _, app := range getStore().MessageApps() {
+		seen[app] = true
+	}
+	// MT:<app>_<token>_<time>_<id>
+	scanRecords(TOKEN_MESSAGE_PREFIX, func(key string, value []byte) bool {
+		parts := strings.Split(strings.TrimPrefix(key, TOKEN_MESSAGE_PREFIX), "_")
+		if len(parts) >= 4 {
+			seen[strings.Join(parts[:len(parts)-3], "_")] = true
+		}
+		return true
+	})
+	apps := make([]string, 0, len(seen))
+	for app := range seen {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+func StartCompactService() {
+	defer CapturePanic("Compact service occur runtime error!")
+	if appConfig.CompactIntervalSecs <= 0 {
+		log.Println("archive compaction is disabled")
+		return
+	}
+	tick := time.NewTicker(time.Duration(appConfig.CompactIntervalSecs) * time.Second)
+
+	for {
+		select {
+		case _ = <-tick.C:
+			runCompactJob()
+		}
+	}
+}
+
+func runCompactJob() {
+	now := time.Now()
+	for _, app := range archiveApps() {
+		removed, stats := compactArchive(app, now)
+		log.Printf("compact archive of %s, removed %d, remaining %d (%d bytes)", app, removed, stats.Messages, stats.Bytes)
+		log.Printf("compact delivery status of %s, removed %d", app, compactStatus(app, now))
+	}
+	log.Printf("compact device registrations, removed %d", compactRegistrations(now))
+}
+
+/**
+GET /v2/admin/archive：各应用存档的条数及大小。
+*/
+func archiveHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	apps := archiveApps()
+	if app := request.FormValue("app"); len(app) != 0 {
+		apps = []string{app}
+	}
+	result := make([]*ArchiveStats, len(apps))
+	for i, app := range apps {
+		result[i] = getArchiveStats(app)
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"apps": result})
+}
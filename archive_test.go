@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	payload, err := MakePayloadFromString(`{
+		"aps": {
+			"alert": {"title": "hi", "loc-key": "GAME", "loc-args": ["a", "b"]},
+			"sound": {"critical": 1, "name": "alarm.aiff", "volume": 0.5},
+			"timestamp": 1700000000,
+			"event": "update",
+			"content-state": {"score": 3, "players": ["a", {"name": "b"}], "done": false}
+		},
+		"custom": {"list": [1, "two", {"three": [3]}], "nested": {"a": {"b": null}}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := &Notification{App: "com.a", Token: "t", Payload: &payload, PushType: PUSH_TYPE_LIVEACTIVITY}
+
+	data := encodeArchive(notification)
+	if data == nil {
+		t.Fatal("can not encode notification")
+	}
+	message := decodeArchive(data)
+	if message == nil || message.StoredAt == 0 {
+		t.Fatalf("can not decode archive %+v", message)
+	}
+	if !reflect.DeepEqual(message.Notification, notification) {
+		t.Fatalf("decoded %+v, want %+v", message.Notification.Payload.Aps, notification.Payload.Aps)
+	}
+}
+
+func TestCompactArchiveKeepsRecentMessages(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.ArchiveMaxAgeSecs = 3600
+	appConfig.ArchiveMaxPerApp = 1
+	store = NewMemoryStore()
+	defer closeStore()
+
+	payload := &Payload{Aps: &AlertInfo{Alert: AlertObject{Title: "hi"}, Sound: SoundObject{Name: "a"}}}
+	for i := int32(1); i <= 3; i++ {
+		StoreMessage(&Notification{App: "com.a", Token: "t", Payload: payload}, i, 0)
+	}
+	if removed, stats := compactArchive("com.a", time.Now()); removed != 0 || stats.Messages != 3 {
+		t.Fatalf("removed %d, remaining %+v", removed, stats)
+	}
+	if message := GetMessage("com.a", 0, 2); message == nil || !reflect.DeepEqual(message.Payload, payload) {
+		t.Fatalf("message is not replayable: %+v", message)
+	}
+	later := time.Now().Add((ARCHIVE_MIN_AGE_SECS + 1) * time.Second)
+	if removed, stats := compactArchive("com.a", later); removed != 2 || stats.Messages != 1 {
+		t.Fatalf("removed %d, remaining %+v", removed, stats)
+	}
+}
+
+func TestCompactCoversRemovedApps(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.ArchiveMaxAgeSecs = 3600
+	store = NewMemoryStore()
+	defer closeStore()
+
+	// 已经没有连接池的应用的存档及sandbox应用的投递记录
+	StoreMessage(&Notification{App: "com.gone", Token: "t", Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}, 1, 0)
+	old := time.Now().Add(-2 * time.Hour)
+	putRecord(fmt.Sprintf("%s%s_%s_%020d_%s", TOKEN_MESSAGE_PREFIX, "com.gone_dev", "t", old.UnixNano(), "id"), []byte("id"))
+	found := make(map[string]bool)
+	for _, app := range archiveApps() {
+		found[app] = true
+	}
+	if !found["com.gone"] || !found["com.gone_dev"] || found["latest"] {
+		t.Fatalf("apps to compact are %v", archiveApps())
+	}
+
+	registerDevice("com.gone", "old", old.Unix())
+	registerDevice("com.gone", "new", time.Now().Unix())
+	if removed := compactRegistrations(time.Now()); removed != 1 {
+		t.Fatalf("removed %d registrations", removed)
+	}
+	if registrationTime("com.gone", "old") != 0 || registrationTime("com.gone", "new") == 0 {
+		t.Fatal("wrong registration is removed")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**
+* bad token的失效时间与设备的注册时间。按苹果的建议，设备在失效时间之后重新注册过，
+* 说明用户重新安装了应用，该token应当恢复推送：
+* - 注册时间晚于失效时间的token会被自动移出bad token集合
+* - 失效时间早于最近一次注册时间的失效通知会被忽略
+ */
+
+const REGISTRATION_PREFIX = "RT:"
+
+func registrationTime(app string, token string) int64 {
+	registeredAt, _ := strconv.ParseInt(string(getRecord(REGISTRATION_PREFIX+app+"_"+token)), 10, 64)
+	return registeredAt
+}
+
+/**
+把token标记为失效，token在invalidAt之后重新注册过时不做标记，返回false。
+*/
+func markBadToken(app string, token string, invalidAt int64) bool {
+	if registeredAt := registrationTime(app, token); registeredAt >= invalidAt {
+		log.Printf("token %s of %s registered at %d, ignore invalidation at %d", token, app, registeredAt, invalidAt)
+		return false
+	}
+	addBadToken(app, token, invalidAt)
+	publishBadToken(app, token, invalidAt)
+	return true
+}
+
+/**
+记录设备的注册时间，token在此之前失效的移出bad token集合，返回是否恢复了该token。
+*/
+func registerDevice(app string, token string, registeredAt int64) bool {
+	putRecord(REGISTRATION_PREFIX+app+"_"+token, []byte(strconv.FormatInt(registeredAt, 10)))
+	invalidAt := badTokenTime(app, token)
+	if invalidAt != 0 && invalidAt < registeredAt {
+		log.Printf("token %s of %s registered again, recover it", token, app)
+		recoverToken(app, token)
+		return true
+	}
+	return false
+}
+
+/**
+清理注册时间超过存档保留时长的注册记录，返回删除的条数。
+*/
+func compactRegistrations(now time.Time) int {
+	cutoff, protected := archiveCutoff(now)
+	var expired []string
+	scanRecords(REGISTRATION_PREFIX, func(key string, value []byte) bool {
+		registeredAt, err := strconv.ParseInt(string(value), 10, 64)
+		if err == nil && registeredAt < cutoff && registeredAt < protected {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	for _, key := range expired {
+		deleteRecord(key)
+	}
+	return len(expired)
+}
+
+/**
+POST /v2/devices：应用每次启动拿到token后调用，参数app、token、sandbox，
+以及可选的registered_at（unix时间戳，默认为当前时间）。
+*/
+func devicesHandler(w http.ResponseWriter, request *http.Request) {
+	dict := readJsonBody(w, request)
+	if dict == nil {
+		return
+	}
+	app := knownAppFromMap(w, dict)
+	if len(app) == 0 {
+		return
+	}
+	token, _ := dict["token"].(string)
+	if err := validateToken(token); err != nil {
+		writeValidationErrors(w, ValidationErrors{err})
+		return
+	}
+	token = normalizeToken(token)
+	registeredAt := time.Now().Unix()
+	if value, ok := dict["registered_at"]; ok {
+		number, ok := value.(float64)
+		if !ok || number <= 0 {
+			writeValidationErrors(w, ValidationErrors{{"registered_at", RULE_TYPE, 0, "registered_at should be a unix timestamp"}})
+			return
+		}
+		registeredAt = int64(number)
+	}
+	recovered := registerDevice(app, token, registeredAt)
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"app": app, "token": token, "registered_at": registeredAt, "recovered": recovered})
+}
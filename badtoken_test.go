@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokenApisIgnoreAppHealth(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+	setupAppsDir(t, map[string]string{"com.a": ""})
+	// 应用处于熔断状态
+	breakersMutex.Lock()
+	breakerFor("com.a").failures[0] = int(appConfig.CircuitBreakFailures)
+	breakersMutex.Unlock()
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, "com.a")
+		breakersMutex.Unlock()
+	}()
+
+	token := `"token":"` + strings.Repeat("a", 64) + `"}`
+	for _, c := range []struct {
+		handler http.HandlerFunc
+		request string
+		status  int
+	}{
+		{devicesHandler, `{"app":"com.a",` + token, http.StatusOK},
+		{recoverHandlerV2, `{"app":"com.a",` + token, http.StatusOK},
+		{devicesHandler, `{"app":"com.a","sandbox":true,` + token, http.StatusNotFound},
+		{recoverHandlerV2, `{"app":"com.unknown",` + token, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("POST", "/v2/devices", strings.NewReader(c.request)))
+		if w.Code != c.status {
+			t.Errorf("%s: got %d %s, want %d", c.request, w.Code, w.Body.String(), c.status)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+* 推送证书的检查。连接前及每隔CERT_CHECK_INTERVAL检查一次每个应用的证书：
+* - 证书与密钥是否匹配、是否过期、是否属于该应用（证书的UID即bundle id）
+* - 离过期还有30、7、1天时各告警一次，写日志并触发certificate_expiry回调
+* 有问题的应用标记为不健康，不会建立连接，/v2/push返回503。
+* 配置了StrictCertificates时，启动时有任何证书有问题都拒绝启动。
+ */
+
+const (
+	CERT_CHECK_INTERVAL = time.Hour
+
+	WEBHOOK_EVENT_CERTIFICATE_EXPIRY = "certificate_expiry"
+)
+
+var CERT_WARNING_DAYS = []int{30, 7, 1}
+
+// 证书Subject中的UID，苹果的推送证书用它存放bundle id
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+var certStatuses map[string]*CertificateStatus = make(map[string]*CertificateStatus)
+var certStatusesMutex sync.Mutex
+
+type CertificateStatus struct {
+	App      string  `json:"app"`
+	Sandbox  bool    `json:"sandbox"`
+	Subject  string  `json:"subject,omitempty"`
+	Topic    string  `json:"topic,omitempty"`     // 证书所属的bundle id
+	NotAfter int64   `json:"not_after,omitempty"` // 过期时间，unix时间戳
+	DaysLeft float64 `json:"days_left"`
+	Healthy  bool    `json:"healthy"`
+	Problem  string  `json:"problem,omitempty"`
+	warned   int     // 已告警的最小天数
+}
+
+func (status *CertificateStatus) Key() string {
+	if status.Sandbox {
+		return status.App + DEVELOP_SUBFIX
+	}
+	return status.App
+}
+
+/**
+检查应用的证书并更新状态。
+*/
+func checkCertificate(app string, sandbox bool, certFile string, keyFile string) *CertificateStatus {
+	status := inspectCertificate(app, sandbox, certFile, keyFile, time.Now())
+
+	certStatusesMutex.Lock()
+	if old := certStatuses[status.Key()]; old != nil && old.NotAfter == status.NotAfter {
+		status.warned = old.warned
+	}
+	certStatuses[status.Key()] = status
+	certStatusesMutex.Unlock()
+
+	if !status.Healthy {
+		log.Printf("certificate of %s is unhealthy: %s", status.Key(), status.Problem)
+	}
+	return status
+}
+
+func inspectCertificate(app string, sandbox bool, certFile string, keyFile string, now time.Time) *CertificateStatus {
+	status := &CertificateStatus{App: app, Sandbox: sandbox}
+	pair, err := loadCertificate(app, certFile, keyFile)
+	if err != nil {
+		status.Problem = fmt.Sprintf("can not load certificate: %s", err)
+		return status
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		status.Problem = fmt.Sprintf("can not parse certificate: %s", err)
+		return status
+	}
+	status.Subject = cert.Subject.CommonName
+	status.NotAfter = cert.NotAfter.Unix()
+	status.DaysLeft = cert.NotAfter.Sub(now).Hours() / 24
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidUserID) {
+			status.Topic = fmt.Sprint(name.Value)
+		}
+	}
+
+	switch {
+	case now.After(cert.NotAfter):
+		status.Problem = fmt.Sprintf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	case now.Before(cert.NotBefore):
+		status.Problem = fmt.Sprintf("certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	case len(status.Topic) != 0 && status.Topic != app:
+		status.Problem = fmt.Sprintf("certificate is issued for %s, not %s", status.Topic, app)
+	default:
+		status.Healthy = true
+	}
+	return status
+}
+
+/**
+应用的证书有问题时返回原因，没有检查过或没有问题时返回空字符串。
+*/
+func certificateProblem(app string) string {
+	certStatusesMutex.Lock()
+	defer certStatusesMutex.Unlock()
+	if status := certStatuses[app]; status != nil && !status.Healthy {
+		return status.Problem
+	}
+	return ""
+}
+
+/**
+检查所有使用证书认证的应用，返回有问题的应用数。
+*/
+func checkCertificates() int {
+	apps, err := scanApps()
+	if err != nil {
+		log.Println("can not scan apps dir", err)
+	}
+	unhealthy := 0
+	for key, entry := range apps {
+		certFile := path.Join(entry.Folder, CERT_FILE_NAME)
+		if _, err := os.Stat(certFile); os.IsNotExist(err) && usesTokenAuth(entry) {
+			continue
+		}
+		status := checkCertificate(entry.App, entry.Sandbox, certFile, path.Join(entry.Folder, KEY_FILE_NAME))
+		if !status.Healthy {
+			unhealthy++
+			continue
+		}
+		warnCertificateExpiry(key, status)
+	}
+	return unhealthy
+}
+
+func usesTokenAuth(entry *appEntry) bool {
+	return len(findAuthKey(entry.Folder)) != 0 || len(findAuthKey(path.Join(appConfig.AppsDir, entry.App))) != 0
+}
+
+/**
+离过期的天数低于某个告警天数时告警一次。
+*/
+func warnCertificateExpiry(key string, status *CertificateStatus) {
+	threshold := 0
+	for _, days := range CERT_WARNING_DAYS {
+		if status.DaysLeft <= float64(days) {
+			threshold = days
+		}
+	}
+	certStatusesMutex.Lock()
+	if threshold == 0 || (status.warned != 0 && status.warned <= threshold) {
+		certStatusesMutex.Unlock()
+		return
+	}
+	status.warned = threshold
+	certStatusesMutex.Unlock()
+
+	log.Printf("WARNING: certificate of %s expires in %.1f days", key, status.DaysLeft)
+	FireWebhook(key, WEBHOOK_EVENT_CERTIFICATE_EXPIRY, map[string]interface{}{
+		"days_left": status.DaysLeft, "not_after": status.NotAfter, "subject": status.Subject})
+}
+
+func StartCertificateService() {
+	defer CapturePanic("Certificate service occur runtime error!")
+	tick := time.NewTicker(CERT_CHECK_INTERVAL)
+
+	for {
+		select {
+		case _ = <-tick.C:
+			checkCertificates()
+		}
+	}
+}
+
+func sortedCertStatuses() []*CertificateStatus {
+	certStatusesMutex.Lock()
+	defer certStatusesMutex.Unlock()
+	result := make([]*CertificateStatus, 0, len(certStatuses))
+	for _, status := range certStatuses {
+		copied := *status
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key() < result[j].Key() })
+	return result
+}
+
+/**
+GET /v2/admin/certificates：各应用证书的状态及离过期的天数。
+*/
+func certificatesHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"certificates": sortedCertStatuses()})
+}
+
+/**
+GET /metrics：Prometheus格式的指标。
+*/
+func metricsHandler(w http.ResponseWriter, request *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	statuses := sortedCertStatuses()
+	fmt.Fprintln(w, "# HELP goapns_certificate_expiry_days Days until the push certificate expires.")
+	fmt.Fprintln(w, "# TYPE goapns_certificate_expiry_days gauge")
+	for _, status := range statuses {
+		if status.NotAfter != 0 {
+			fmt.Fprintf(w, "goapns_certificate_expiry_days{app=%q,env=%q} %.2f\n", status.App, envName(status.Sandbox), status.DaysLeft)
+		}
+	}
+	fmt.Fprintln(w, "# HELP goapns_certificate_healthy Whether the push certificate is usable.")
+	fmt.Fprintln(w, "# TYPE goapns_certificate_healthy gauge")
+	for _, status := range statuses {
+		healthy := 0
+		if status.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "goapns_certificate_healthy{app=%q,env=%q} %d\n", status.App, envName(status.Sandbox), healthy)
+	}
+}
+
+func envName(sandbox bool) string {
+	if sandbox {
+		return DEVELOP_FOLDER
+	}
+	return PRODUCTION_FOLDER
+}
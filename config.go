@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"strings"
 )
 
 func Initialize(path *string) {
@@ -15,7 +18,7 @@ func Initialize(path *string) {
 
 	file, err := os.Open(*path)
 	if err != nil {
-		log.Fatalf("config file %d not found\n", *path)
+		log.Fatalf("config file %s not found\n", *path)
 	}
 	content := make([]byte, 1024)
 
@@ -33,3 +36,51 @@ func Initialize(path *string) {
 
 	appConfig.Display()
 }
+
+/**
+读取应用目录下的app.json，文件不存在时返回默认配置。
+*/
+func loadAppOptions(app string) AppOptions {
+	options := AppOptions{Transport: appConfig.DefaultTransport}
+	content, err := ioutil.ReadFile(path.Join(appConfig.AppsDir, app, APP_OPTIONS_FILE_NAME))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("can not read %s for %s: %s", APP_OPTIONS_FILE_NAME, app, err)
+		}
+		return options
+	}
+	err = json.Unmarshal(content, &options)
+	if err != nil {
+		log.Printf("wrong json format in %s for %s: %s", APP_OPTIONS_FILE_NAME, app, err)
+	}
+	if len(options.Transport) == 0 {
+		options.Transport = appConfig.DefaultTransport
+	}
+	return options
+}
+
+/**
+应用使用的通道，key为sockets的key。扫描AppsDir时已确定并记在appEntry中，
+在两次扫描之间新增的应用才读取目录。
+*/
+func appTransport(key string) string {
+	knownAppsMutex.Lock()
+	entry := knownApps[key]
+	knownAppsMutex.Unlock()
+	if entry != nil {
+		return entry.Transport
+	}
+	return resolveTransport(key)
+}
+
+/**
+从应用目录确定通道：使用Token认证的应用只能走HTTP/2，否则以app.json为准。
+*/
+func resolveTransport(key string) string {
+	app := strings.Replace(key, DEVELOP_SUBFIX, "", 1)
+	sandbox := strings.HasSuffix(key, DEVELOP_SUBFIX)
+	if len(findAuthKey(appFolder(app, sandbox))) != 0 || len(findAuthKey(path.Join(appConfig.AppsDir, app))) != 0 {
+		return TRANSPORT_HTTP2
+	}
+	return loadAppOptions(app).Transport
+}
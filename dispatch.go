@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/**
+* 消息的发送流程：
+* - 入口（HTTP接口、Redis队列、重发）调用Notify，消息放进某个连接的发送队列，不会阻塞
+* - 每个连接有一个写消息的goroutine，二进制通道依次发送队列中的消息，同一个连接上的消息保持先后顺序；
+*   HTTP/2通道的每条消息是独立的请求，每个连接最多同时进行Http2MaxStreams个请求
+* - 发送队列的长度为ConnectionQueueSize，所有连接的队列都满时Notify返回errQueueFull，
+*   HTTP接口返回503，Redis队列中的消息留在队列中
+* - 没有可用的连接或还有等待重发的消息时，消息放进ErrorBucket，由写消息的goroutine优先发送
+ */
+
+var (
+	errNoConnection = errors.New("no connection to apns")
+	errQueueFull    = errors.New("dispatch queue is full, please retry later")
+	errUnknownApp   = errors.New("unknown app")
+)
+
+/**
+接收一条要推送的消息。消息被丢弃或无法接收时返回错误。
+*/
+func Notify(message *Notification) error {
+	pool := getPool(message.App)
+	if pool == nil {
+		RecordStatus(message, STATUS_DROPPED, 0, errUnknownApp.Error())
+		return errUnknownApp
+	}
+	// 还有等待重发的消息时排在它们后面，保持顺序。
+	if HasPendingMessage(message.App) {
+		if !AddFallbackMessage(message) {
+			return errQueueFull
+		}
+		return nil
+	}
+	err := pool.Dispatch(message)
+	if err == errNoConnection {
+		// 扔进等待队列，连接恢复后再发。
+		if !AddErrorMessage(message) {
+			return errQueueFull
+		}
+		return nil
+	}
+	if err != nil {
+		log.Printf("dispatch queue of %s is full, reject message %s", message.App, message.ApnsID)
+		RecordStatus(message, STATUS_DROPPED, 0, err.Error())
+	}
+	return err
+}
+
+/**
+放进该连接的发送队列，连接已关闭或队列已满时返回false。
+*/
+func (info *ConnectInfo) offer(message *Notification) bool {
+	info.mutext.Lock()
+	defer info.mutext.Unlock()
+	if !info.isConnected() {
+		return false
+	}
+	select {
+	case info.queue <- message:
+		atomic.AddInt32(&info.inflight, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+连接建立后启动写消息的goroutine。
+*/
+func (info *ConnectInfo) startWriter() {
+	size := appConfig.ConnectionQueueSize
+	if size <= 0 {
+		size = 1
+	}
+	info.queue = make(chan *Notification, size)
+	info.done = make(chan struct{})
+	info.writers.Add(1)
+	if info.Transport == TRANSPORT_HTTP2 {
+		streams := appConfig.Http2MaxStreams
+		if streams <= 0 {
+			streams = 1
+		}
+		info.streams = make(chan struct{}, streams)
+	}
+	go info.runWriter()
+}
+
+func (info *ConnectInfo) runWriter() {
+	defer info.writers.Done()
+	defer CapturePanic("writer of " + info.App + " stopped")
+	bucket := ErrorBucketForApp(info.App)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-info.done:
+			info.drain()
+			return
+		default:
+		}
+		// 先发等待重发的消息
+		if message := bucket.Next(); message != nil {
+			atomic.AddInt32(&info.inflight, 1)
+			info.process(message)
+			continue
+		}
+		select {
+		case <-info.done:
+			info.drain()
+			return
+		case message := <-info.queue:
+			info.process(message)
+		case <-tick.C:
+		}
+	}
+}
+
+/**
+发送一条消息。二进制通道在写消息的goroutine中发送；HTTP/2通道另起goroutine发送，
+同时进行的请求满了之后等待其中一个完成。
+*/
+func (info *ConnectInfo) process(message *Notification) {
+	if info.streams == nil {
+		info.send(message)
+		atomic.AddInt32(&info.inflight, -1)
+		return
+	}
+	select {
+	case info.streams <- struct{}{}:
+	case <-info.done:
+		// 连接已关闭，放回等待队列。
+		atomic.AddInt32(&info.inflight, -1)
+		info.drain(message)
+		return
+	}
+	info.writers.Add(1)
+	go func() {
+		defer info.writers.Done()
+		defer func() {
+			<-info.streams
+			atomic.AddInt32(&info.inflight, -1)
+		}()
+		info.send(message)
+	}()
+}
+
+/**
+连接关闭后，把没发出去的消息（first）及队列中还没发的消息按原来的顺序放回ErrorBucket，等其他连接或新连接发送。
+*/
+func (info *ConnectInfo) drain(first ...*Notification) {
+	messages := first
+queue:
+	for {
+		select {
+		case message := <-info.queue:
+			atomic.AddInt32(&info.inflight, -1)
+			messages = append(messages, message)
+		default:
+			break queue
+		}
+	}
+	if len(messages) != 0 {
+		ErrorBucketForApp(info.App).Requeue(messages)
+	}
+}
+
+/**
+发送一条消息，二进制通道只在写消息的goroutine中调用。
+*/
+func (info *ConnectInfo) send(message *Notification) {
+	defer CapturePanic("notify fail")
+	// 先看该token是否在badtoken集合内
+	if isBadToken(message.App, message.Token) {
+		log.Println("token is a bad token ,skip push :", message.Token)
+		RecordStatus(message, STATUS_DROPPED, 0, "bad token")
+		return
+	}
+	if message.Expiry > 0 && message.Expiry < time.Now().Unix() {
+		log.Println("message expired, skip push :", message.ApnsID)
+		RecordStatus(message, STATUS_EXPIRED, 0, "")
+		return
+	}
+	conn, client := info.conn()
+	if conn == nil && client == nil {
+		// 连接已关闭，放回等待队列。
+		info.drain(message)
+		return
+	}
+
+	// HTTP/2的client会自己处理空闲连接，无需主动重连。
+	if info.Transport != TRANSPORT_HTTP2 &&
+		time.Now().Unix()-info.lastActivity > appConfig.ConnectionIdleSecs {
+		log.Println("connection is idle for a long time, reconnect!")
+		// 先关闭连接，不再接收新消息，再把该消息及队列中的消息按顺序放回，新连接会先发送它们。
+		connected := info.Disconnect()
+		info.drain(message)
+		if connected {
+			connectSlot(info.App, info.Sandbox, info.slot)
+		}
+		return
+	}
+
+	sequence := info.sequence
+	msgID := sequence.Next()
+	log.Println("store message into database")
+	StoreMessage(message, msgID, sequence.number)
+	// 消息存入缓存，过期消失，如果失败会尝试重发。
+	log.Println("push!")
+	var err error
+	if info.Transport == TRANSPORT_HTTP2 {
+		err = pushMessageHttp2(info, client, msgID, message)
+	} else {
+		err = pushMessage(conn, msgID, message)
+		if _, ok := err.(*socketError); ok {
+			info.writeFailed(message, msgID, err)
+			return
+		}
+		if err == nil {
+			RecordStatus(message, STATUS_SENT, 0, "")
+		}
+		info.lastActivity = time.Now().Unix()
+	}
+	if err != nil {
+		// 消息无法发送（如token不是32字节、签发provider token失败）
+		log.Printf("drop message %s: %s", message.ApnsID, err)
+		RecordStatus(message, STATUS_DROPPED, 0, err.Error())
+		fireRejectedWebhook(message, 0, err.Error(), false)
+	}
+	log.Println("finish push")
+}
+
+/**
+写socket出错，苹果没有收到这条消息。连接已被出错处理（HandleError）关闭时，由它按消息ID重发；
+否则关闭连接，删除存档以免出错处理再发一次，把消息及队列中的消息放回等待队列，按退避重连后发送。
+*/
+func (info *ConnectInfo) writeFailed(message *Notification, msgID int32, err error) {
+	if !info.Disconnect() {
+		return
+	}
+	getStore().DeleteMessage(info.App, info.sequence.number, msgID)
+	RecordStatus(message, STATUS_REPLAYED, 0, err.Error())
+	info.drain(message)
+	connectFailed(info.App, info.Sandbox, info.slot, err)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHttp2WriterSendsConcurrently(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.Http2MaxStreams = 4
+	store = NewMemoryStore()
+	defer closeStore()
+
+	var active, peak int32
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&active, -1)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	appConfig.Http2Endpoint = srv.URL
+
+	info := connectHttp2("com.a", srv.Client().Transport.(*http.Transport).TLSClientConfig, false)
+	info.sequence = newIdentitySequence()
+	info.startWriter()
+	defer info.Disconnect()
+
+	payload := &Payload{Aps: &AlertInfo{Alert: "hi"}}
+	for i := 0; i < 8; i++ {
+		if !info.offer(&Notification{App: "com.a", Token: strings.Repeat("a", 64), Payload: payload}) {
+			t.Fatal("queue is full")
+		}
+	}
+	waitFor(t, "concurrent streams", func() bool { return atomic.LoadInt32(&peak) == 4 })
+	close(release)
+	waitFor(t, "all messages sent", func() bool { return atomic.LoadInt32(&info.inflight) == 0 })
+	if peak != 4 {
+		t.Fatalf("%d concurrent streams, want 4", peak)
+	}
+}
+
+func TestDrainKeepsOrder(t *testing.T) {
+	appConfig = NewConfig()
+	defer removeErrorBucket("com.a")
+	info := &ConnectInfo{App: "com.a", queue: make(chan *Notification, 3)}
+	messages := make([]*Notification, 4)
+	for i := range messages {
+		messages[i] = &Notification{App: "com.a", ApnsID: string(rune('a' + i))}
+	}
+	info.queue <- messages[1]
+	info.queue <- messages[2]
+	info.inflight = 2
+	// 连接关闭前已在等待的新消息排在后面
+	AddFallbackMessage(messages[3])
+
+	info.drain(messages[0])
+	bucket := ErrorBucketForApp("com.a")
+	for i, want := range messages {
+		if got := bucket.Next(); got != want {
+			t.Fatalf("message %d is %+v, want %+v", i, got, want)
+		}
+	}
+	if info.inflight != 0 {
+		t.Fatalf("inflight is %d after drain", info.inflight)
+	}
+}
+
+func TestBinaryWriteErrorRequeues(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+	defer removeErrorBucket("com.write")
+	// 不真的去重连
+	breakersMutex.Lock()
+	breakerFor("com.write").pending[0] = true
+	breakersMutex.Unlock()
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, "com.write")
+		breakersMutex.Unlock()
+	}()
+
+	clientConn, serverConn := net.Pipe()
+	serverConn.Close()
+	info := &ConnectInfo{App: "com.write", Connection: tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}),
+		sequence: newIdentitySequence(), lastActivity: time.Now().Unix(),
+		queue: make(chan *Notification, 1), done: make(chan struct{})}
+	payload := &Payload{Aps: &AlertInfo{Alert: "hi"}}
+	message := &Notification{App: "com.write", Token: strings.Repeat("a", 64), ApnsID: NewUUID(), Payload: payload}
+	queued := &Notification{App: "com.write", Token: strings.Repeat("b", 64), ApnsID: NewUUID(), Payload: payload}
+	info.queue <- queued
+	info.inflight = 1
+
+	info.send(message)
+	if info.IsConnected() {
+		t.Fatal("connection is not closed after a write error")
+	}
+	if status := getMessageStatus(message.ApnsID); status == nil || status.Status != STATUS_REPLAYED {
+		t.Fatalf("message status is %+v", status)
+	}
+	// 出错处理不会按消息ID再发一次
+	if GetMessage("com.write", info.sequence.number, info.sequence.last) != nil {
+		t.Fatal("archived message is not removed")
+	}
+	bucket := ErrorBucketForApp("com.write")
+	for _, want := range []*Notification{message, queued} {
+		if got := bucket.Next(); got != want {
+			t.Fatalf("requeued %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestShutdownReturnsUnsentMessagesToRedis(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.QueueWithRedis = true
+	cli := newRedisClient()
+	defer cli.Close()
+	if err := cli.Ping().Err(); err != nil {
+		t.Skip("redis is not available: ", err)
+	}
+	queue := EXTERN_MESSAGE_QUEUE_PREFIX + "com.shutdown"
+	cli.Del(queue)
+	defer cli.Del(queue)
+	store = NewMemoryStore()
+	defer func() {
+		storeMutex.Lock()
+		storeClosed = false
+		storeMutex.Unlock()
+		poolsClosed.Store(false)
+	}()
+	defer removeErrorBucket("com.shutdown")
+	defer removePool("com.shutdown")
+	breakersMutex.Lock()
+	breakerFor("com.shutdown").pending[0] = true
+	breakersMutex.Unlock()
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, "com.shutdown")
+		breakersMutex.Unlock()
+	}()
+
+	// 对端已关闭，写消息的goroutine发送时出错，消息放回ErrorBucket
+	clientConn, serverConn := net.Pipe()
+	serverConn.Close()
+	info := &ConnectInfo{App: "com.shutdown", Connection: tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}),
+		sequence: newIdentitySequence(), lastActivity: time.Now().Unix()}
+	info.startWriter()
+	ensurePool("com.shutdown", false).Put(info)
+	payload := &Payload{Aps: &AlertInfo{Alert: "hi"}}
+	first := &Notification{App: "com.shutdown", Token: strings.Repeat("a", 64), ApnsID: NewUUID(), Payload: payload, Priority: 5}
+	second := &Notification{App: "com.shutdown", Token: strings.Repeat("b", 64), ApnsID: NewUUID(), Payload: payload}
+	AddErrorMessage(first)
+	AddErrorMessage(second)
+
+	shutdown()
+	if info.IsConnected() {
+		t.Fatal("connection is not closed")
+	}
+	items, err := cli.LRange(queue, 0, -1).Result()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("queue is %v, %v", items, err)
+	}
+	// BRPOP从右边取，第一条消息在最右边
+	for i, want := range []*Notification{second, first} {
+		var dict map[string]interface{}
+		if err := json.Unmarshal([]byte(items[i]), &dict); err != nil {
+			t.Fatal(err)
+		}
+		notifications, _, err := MakeNotificationsFromMap(dict, "com.shutdown")
+		if err != nil || len(notifications) != 1 {
+			t.Fatalf("can not read %s: %v", items[i], err)
+		}
+		got := notifications[0]
+		if got.ApnsID != want.ApnsID || got.Token != want.Token || got.Priority != want.Priority {
+			t.Errorf("queued %+v, want %+v", got, want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("store is reopened after shutdown")
+		}
+	}()
+	getStore()
+}
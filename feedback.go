@@ -1,102 +1,184 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"net/http"
 	"path"
-	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 )
 
+/**
+* feedback服务返回的每个失效设备为一个tuple：
+* timestamp(4) | token length(2) | token
+* timestamp为苹果确认该设备不再接收推送的时间，token为二进制。
+ */
+
+const (
+	FEEDBACK_TUPLE_HEADER_SIZE = 6
+	FEEDBACK_READ_TIMEOUT      = 30 * time.Second
+)
+
+type FeedbackResult struct {
+	App    string `json:"app"`
+	Tokens int    `json:"tokens"` // 收到的失效token数
+	Error  string `json:"error,omitempty"`
+}
+
 func StartFeedbackService() {
 	defer CapturePanic("Feedback service occur runtime error!")
-	tick := time.NewTicker(1 * time.Hour)
+	if appConfig.FeedbackIntervalSecs <= 0 {
+		log.Println("feedback service is disabled")
+		return
+	}
+	tick := time.NewTicker(time.Duration(appConfig.FeedbackIntervalSecs) * time.Second)
 
 	for {
 		select {
 		case _ = <-tick.C:
 			log.Println("get up for the dead tokens!")
-			runFeedbackJob()
+			runFeedbackJob("")
 		}
 	}
 }
 
-func runFeedbackJob() {
-	// 遍历应用，创建对应连接收取非法device
-	walkErr := filepath.Walk(appConfig.AppsDir, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if !info.IsDir() {
-			return nil
-		}
-
-		if info.Name() != DEVELOP_FOLDER && info.Name() != PRODUCTION_FOLDER {
-			return nil
-		}
-
-		buff := bytes.NewBufferString(appConfig.AppsDir)
-		buff.WriteRune(os.PathSeparator)
-		app := strings.Replace(path.Dir(filePath), buff.String(), "", 1)
-		sandbox := false
-		if info.Name() == DEVELOP_FOLDER {
-			sandbox = true
-		}
-		go getFeedback(app,
-			path.Join(filePath, KEY_FILE_NAME),
-			path.Join(filePath, CERT_FILE_NAME),
-			sandbox)
-		return nil
-	})
+/**
+收取所有应用（app不为空时只收取该应用）的feedback，等待全部完成后返回结果。
+*/
+func runFeedbackJob(app string) []*FeedbackResult {
+	var results []*FeedbackResult
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
 
+	// 遍历应用，创建对应连接收取非法device
+	apps, walkErr := scanApps()
 	if walkErr != nil {
 		log.Print("读取证书有问题哇", walkErr)
 	}
+	for _, entry := range apps {
+		if len(app) != 0 && entry.App != app {
+			continue
+		}
+		wg.Add(1)
+		go func(entry *appEntry) {
+			defer wg.Done()
+			result := getFeedback(entry.App,
+				path.Join(entry.Folder, KEY_FILE_NAME),
+				path.Join(entry.Folder, CERT_FILE_NAME),
+				entry.Sandbox)
+			if result != nil {
+				mutex.Lock()
+				results = append(results, result)
+				mutex.Unlock()
+			}
+		}(entry)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].App < results[j].App })
+	return results
 }
 
-func getFeedback(app string, keyFile string, certFile string, sandbox bool) {
-	// 连接feedback service and read。
+/**
+连接feedback服务，读出所有失效的token并加入bad token集合。
+使用Token认证的应用没有证书，feedback服务只支持证书认证，返回nil。
+*/
+func getFeedback(app string, keyFile string, certFile string, sandbox bool) *FeedbackResult {
 	log.Println("get feedback")
 	defer CapturePanic(fmt.Sprintf("get feedback for %s fail", app))
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	cert, err := loadCertificate(app, certFile, keyFile)
+	if sandbox {
+		app = app + DEVELOP_SUBFIX
+	}
+	if err != nil {
+		log.Printf("server : loadKeys: %s, skip feedback for %s", err, app)
+		return nil
+	}
+	result := &FeedbackResult{App: app}
+	config, err := newTLSConfig([]tls.Certificate{cert})
 	if err != nil {
-		log.Printf("server : loadKeys: %s", err)
+		log.Printf("server : tlsConfig: %s, skip feedback for %s", err, app)
+		result.Error = err.Error()
+		return result
 	}
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
 	endPoint := APNS_FEEDBACK_ENDPOINT
 	if sandbox {
 		endPoint = APNS_SANDBOX_FEEDBACK_ENDPOINT
 	}
-	conn, err := tls.Dial("tcp", endPoint, &config)
-	defer conn.Close()
-
+	conn, err := tls.Dial("tcp", endPoint, config)
 	if err != nil {
+		err = describeTLSError(err)
 		log.Println("error when connection to feedback server", err)
-		return
+		result.Error = err.Error()
+		return result
 	}
+	defer conn.Close()
 
 	for {
-		info := make([]byte, 6)
-		n, err := conn.Read(info)
-		if n < 6 || err != nil {
-			log.Println("1 EOF? ", err)
+		conn.SetReadDeadline(time.Now().Add(FEEDBACK_READ_TIMEOUT))
+		timestamp, token, err := readFeedbackTuple(conn)
+		if err == io.EOF {
 			break
 		}
-		length := bytes.NewBuffer(info[4:])
-		var tokenLength int16
-		binary.Read(length, binary.BigEndian, &tokenLength)
-
-		token := make([]byte, tokenLength)
-		n, err = conn.Read(token)
-		if n < int(tokenLength) || err != nil {
-			log.Println("2 EOF? ", err)
+		if err != nil {
+			log.Printf("error when read feedback of %s: %s", app, err)
+			result.Error = err.Error()
 			break
 		}
-		addBadToken(app, string(token))
+		log.Printf("feedback: %s of %s is invalid since %d", token, app, timestamp)
+		result.Tokens++
+		if !markBadToken(app, token, timestamp) {
+			continue
+		}
+		FireWebhook(app, WEBHOOK_EVENT_INVALID_TOKEN, map[string]interface{}{
+			"token": token, "reason": "feedback", "timestamp": timestamp})
+	}
+	log.Printf("got %d invalid tokens from feedback of %s", result.Tokens, app)
+	return result
+}
+
+/**
+读出一个tuple，token以十六进制返回。服务器正常关闭连接时返回io.EOF。
+*/
+func readFeedbackTuple(reader io.Reader) (int64, string, error) {
+	header := make([]byte, FEEDBACK_TUPLE_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, "", fmt.Errorf("incomplete tuple header: %s", err)
+		}
+		return 0, "", err
+	}
+	timestamp := binary.BigEndian.Uint32(header[0:4])
+	tokenLength := binary.BigEndian.Uint16(header[4:6])
+
+	token := make([]byte, tokenLength)
+	if _, err := io.ReadFull(reader, token); err != nil {
+		return 0, "", fmt.Errorf("incomplete token: %s", err)
+	}
+	return int64(timestamp), hex.EncodeToString(token), nil
+}
+
+/**
+POST /v2/admin/feedback：立即收取feedback，可以用app参数只收取一个应用。
+*/
+func feedbackHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+	app := request.FormValue("app")
+	if len(app) != 0 && getPool(app) == nil && getPool(app+DEVELOP_SUBFIX) == nil {
+		writeApiError(w, http.StatusNotFound, "unknown app "+app)
+		return
+	}
+	results := runFeedbackJob(app)
+	if results == nil {
+		results = []*FeedbackResult{}
 	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"apps": results})
 }
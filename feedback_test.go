@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadFeedbackTuple(t *testing.T) {
+	// timestamp 256, token abcd，之后是不完整的tuple
+	reader := bytes.NewReader([]byte{0, 0, 1, 0, 0, 2, 0xab, 0xcd, 0, 0, 0, 5, 0, 32})
+	timestamp, token, err := readFeedbackTuple(reader)
+	if timestamp != 256 || token != "abcd" || err != nil {
+		t.Fatalf("got %d %s %v", timestamp, token, err)
+	}
+	if _, _, err = readFeedbackTuple(reader); err == nil || err == io.EOF {
+		t.Fatalf("incomplete tuple is read as %v", err)
+	}
+	if _, _, err = readFeedbackTuple(bytes.NewReader([]byte{0, 0, 1, 0, 0, 32, 1})); err == nil || err == io.EOF {
+		t.Fatalf("incomplete token is read as %v", err)
+	}
+	if _, _, err = readFeedbackTuple(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("got %v at the end of feedback, want EOF", err)
+	}
+}
+
+func TestMixedCaseTokenMatchesFeedback(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+	setupAppsDir(t, map[string]string{"com.a": ""})
+
+	raw := []byte{0xab, 0xcd}
+	token := strings.Repeat("ABcd", 16)
+	// feedback服务返回的token为小写
+	addBadToken("com.a", hex.EncodeToString(bytes.Repeat(raw, 16)), 100)
+
+	template := &Notification{App: "com.a", Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}
+	message, err := template.ForToken("token", token, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBadToken(message.App, message.Token) {
+		t.Fatalf("token %s is not found in the bad tokens", message.Token)
+	}
+
+	w := httptest.NewRecorder()
+	devicesHandler(w, httptest.NewRequest("POST", "/v2/devices",
+		strings.NewReader(`{"app": "com.a", "registered_at": 200, "token": "`+token+`"}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"recovered":true`) || isBadToken("com.a", message.Token) {
+		t.Fatalf("registration of %s: %d %s", token, w.Code, w.Body.String())
+	}
+}
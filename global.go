@@ -1,36 +1,52 @@
 package main
 
 import (
+	"crypto/rand"
+	"fmt"
 	"log"
-	"math"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 )
 
 ////////////////////// Global Variables ///////////////////////////
 
 /// channels
 var socketCN chan *ConnectInfo = make(chan *ConnectInfo, 10)
-var messageCN chan *Notification = make(chan *Notification, 1000) // message channel
-var responseCN chan *APNSRespone = make(chan *APNSRespone, 100)   // error responses from apns
-var identityCN chan int32 = make(chan int32, 4)                   // id generator channel
-var countDownCN chan int32 = make(chan int32)                     // countdown timer channel
+var responseCN chan *APNSRespone = make(chan *APNSRespone, 100) // error responses from apns
+var countDownCN chan int32 = make(chan int32)                   // countdown timer channel
 
-// socket container
-var sockets map[string]*ConnectInfo = make(map[string]*ConnectInfo)
+// socket container，通过getPool等函数访问
+var sockets map[string]*ConnectionPool = make(map[string]*ConnectionPool)
+var socketsMutex sync.RWMutex
 
 var errorBuckets map[string]*ErrorBucket = make(map[string]*ErrorBucket)
+var errorBucketsMutex sync.Mutex
 
 // configs
 
 var (
 	appConfig AppConfig
 
-	shutingDown   bool
+	shutingDown   atomic.Bool // 由main设置，HTTP接口及Redis队列的goroutine读取
+	poolsClosed   atomic.Bool // 关闭服务器时所有连接已关闭，不再重连
 	countDownTime int
 )
 
 var APNS_ERROR map[string]string = make(map[string]string)
 
+// 所有合法的apns-push-type及其要求的apns-topic后缀
+var PUSH_TYPE_TOPIC_SUFFIX map[string]string = map[string]string{
+	PUSH_TYPE_ALERT:        "",
+	PUSH_TYPE_BACKGROUND:   "",
+	PUSH_TYPE_VOIP:         ".voip",
+	PUSH_TYPE_COMPLICATION: ".complication",
+	PUSH_TYPE_FILEPROVIDER: ".pushkit.fileprovider",
+	PUSH_TYPE_MDM:          "",
+	PUSH_TYPE_LOCATION:     ".location-query",
+	PUSH_TYPE_LIVEACTIVITY: ".push-type.liveactivity",
+}
+
 const (
 	APNS_ERROR_NO_ERROR             = 0
 	APNS_ERROR_PROCESSING_ERROR     = 1
@@ -44,6 +60,11 @@ const (
 	APNS_ERROR_SHUTDOWN             = 10
 	APNS_ERROR_NONE                 = 255
 
+	// 以下为HTTP/2通道特有的错误，二进制协议没有对应的错误码
+	APNS_ERROR_EXPIRED_PROVIDER_TOKEN = 11
+	APNS_ERROR_INVALID_PROVIDER_TOKEN = 12
+	APNS_ERROR_TOO_MANY_REQUESTS      = 13
+
 	DEVELOP_SUBFIX    = "_dev"
 	DEVELOP_FOLDER    = "develop"
 	PRODUCTION_FOLDER = "production"
@@ -54,13 +75,65 @@ const (
 	APNS_SANDBOX_ENDPOINT          = "gateway.sandbox.push.apple.com:2195"
 	APNS_FEEDBACK_ENDPOINT         = "feedback.push.apple.com:2196"
 	APNS_SANDBOX_FEEDBACK_ENDPOINT = "feedback.sandbox.push.apple.com:2196"
+	APNS_HTTP2_ENDPOINT            = "https://api.push.apple.com"
+	APNS_HTTP2_SANDBOX_ENDPOINT    = "https://api.sandbox.push.apple.com"
+
+	TRANSPORT_BINARY      = "binary"
+	TRANSPORT_HTTP2       = "http2"
+	APP_OPTIONS_FILE_NAME = "app.json"
+
+	AUTH_KEY_FILE_PREFIX = "AuthKey_"
+	AUTH_KEY_FILE_SUFFIX = ".p8"
+	P12_FILE_SUFFIX      = ".p12"
+	TOKEN_REFRESH_SECS   = 50 * 60 // provider token一小时过期，提前刷新
+
+	PUSH_TYPE_ALERT        = "alert"
+	PUSH_TYPE_BACKGROUND   = "background"
+	PUSH_TYPE_VOIP         = "voip"
+	PUSH_TYPE_COMPLICATION = "complication"
+	PUSH_TYPE_FILEPROVIDER = "fileprovider"
+	PUSH_TYPE_MDM          = "mdm"
+	PUSH_TYPE_LOCATION     = "location"
+	PUSH_TYPE_LIVEACTIVITY = "liveactivity"
+
+	LIVE_ACTIVITY_EVENT_START  = "start"
+	LIVE_ACTIVITY_EVENT_UPDATE = "update"
+	LIVE_ACTIVITY_EVENT_END    = "end"
+
+	PAYLOAD_MAX_SIZE        = 4096
+	VOIP_PAYLOAD_MAX_SIZE   = 5120
+	BINARY_PAYLOAD_MAX_SIZE = 2048 // 二进制协议command 2的上限，更早的command 0/1为256字节，这里不使用
+	COLLAPSE_ID_MAX_SIZE    = 64
+	TOKEN_MIN_LENGTH        = 64
+	TOKEN_MAX_LENGTH        = 200
+	BINARY_TOKEN_LENGTH     = 64 // 二进制协议的token固定为32字节
+	HTTP2_MAX_RETRIES       = 5  // HTTP/2通道一条消息最多重发的次数
+
+	SHRINK_ALERT_BODY     = "alert.body"
+	SHRINK_ALERT_TITLE    = "alert.title"
+	SHRINK_ALERT_SUBTITLE = "alert.subtitle"
+	SHRINK_ALERT_LOC_ARGS = "alert.loc-args"
+	SHRINK_CUSTOM_PREFIX  = "custom."
+
+	APNS_PRIORITY_IMMEDIATELY  = 10
+	APNS_PRIORITY_POWER_SAVING = 5
+
+	// command 2 的帧内各项
+	FRAME_ITEM_TOKEN      = 1
+	FRAME_ITEM_PAYLOAD    = 2
+	FRAME_ITEM_IDENTIFIER = 3
+	FRAME_ITEM_EXPIRATION = 4
+	FRAME_ITEM_PRIORITY   = 5
 
 	SHUTDOWN_COUNTDOWN_TIME = 4
+	SHUTDOWN_MAX_WAIT_TIME  = 60 // 关闭时最多等待消息发完的秒数，超时后没发出的消息放回Redis队列
 
 	EXTERN_MESSAGE_QUEUE_PREFIX = "goapns:message:"
+
+	SHRINK_HEADER = "X-Goapns-Shrink"
 )
 
-func LogError(errno byte, msgID int32) {
+func ErrorMessage(errno byte) string {
 	errMsg := "NO errors encountered"
 	switch errno {
 	case APNS_ERROR_PROCESSING_ERROR:
@@ -81,28 +154,20 @@ func LogError(errno byte, msgID int32) {
 		errMsg = "Invalid token"
 	case APNS_ERROR_SHUTDOWN:
 		errMsg = "Shutdown"
+	case APNS_ERROR_EXPIRED_PROVIDER_TOKEN:
+		errMsg = "Expired provider token"
+	case APNS_ERROR_INVALID_PROVIDER_TOKEN:
+		errMsg = "Invalid provider token"
+	case APNS_ERROR_TOO_MANY_REQUESTS:
+		errMsg = "Too many requests"
 	case APNS_ERROR_NONE:
 		errMsg = "None (unknown)"
 	}
-	log.Printf("send message %d error: %s", msgID, errMsg)
-}
-
-// Identity Generator
-
-var identity int32
-var generatorRound int
-
-func GenerateIdentity() {
-	for generatorRound = 0; generatorRound < math.MaxInt32; generatorRound++ {
-		for identity = getLatestIdentity(); identity < math.MaxInt32; identity++ {
-			identityCN <- identity + 1
-			storeLatestIdentity(identity + 1)
-		}
-	}
+	return errMsg
 }
 
-func GetIdentity() int32 {
-	return <-identityCN
+func LogError(errno byte, msgID int32) {
+	log.Printf("send message %d error: %s", msgID, ErrorMessage(errno))
 }
 
 func CapturePanic(message string) {
@@ -111,3 +176,16 @@ func CapturePanic(message string) {
 		log.Printf("got runtime panic %v\n, stack %s\n", err, debug.Stack())
 	}
 }
+
+/**
+生成随机的UUID(v4)，用作消息ID及apns-id。
+*/
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("can not read random bytes", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
@@ -17,6 +19,7 @@ func StartHttpServer() error {
 	http.HandleFunc("/push", pushHandler)
 	http.HandleFunc("/push2", pushHandler2)
 	http.HandleFunc("/recover_token", recoverHandler)
+	registerApiV2()
 	return http.ListenAndServe(":"+strconv.Itoa(int(appConfig.AppPort)), nil)
 }
 
@@ -35,7 +38,7 @@ func recoverHandler(w http.ResponseWriter, request *http.Request) {
 		app = app + DEVELOP_SUBFIX
 	}
 
-	token := request.FormValue("token")
+	token := normalizeToken(request.FormValue("token"))
 	if len(token) == 0 {
 		io.WriteString(w, "token is required")
 		return
@@ -56,10 +59,16 @@ func recoverHandler(w http.ResponseWriter, request *http.Request) {
 - sound
 - custom
 - sandbox
+- expiry
+- priority
+- push_type
+- collapse_id
+- topic
+- apns_id
 */
 func pushHandler2(w http.ResponseWriter, request *http.Request) {
 	log.Print("handle push request")
-	if shutingDown {
+	if shutingDown.Load() {
 		io.WriteString(w, "server maintaining... please try later")
 		return
 	}
@@ -79,21 +88,45 @@ func pushHandler2(w http.ResponseWriter, request *http.Request) {
 		sandbox = true
 		app = app + DEVELOP_SUBFIX
 	}
-	if sockets[app] == nil {
+	if getPool(app) == nil {
 		io.WriteString(w, "invalid app")
 		return
 	}
-	message := request.FormValue("message")
-	badge, err := strconv.Atoi(request.FormValue("badge"))
-	if err != nil {
-		log.Println(err)
-		badge = 0
+	if problem := appUnavailable(app); len(problem) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "app is unavailable: "+problem)
+		return
 	}
+	message := request.FormValue("message")
 	sound := request.FormValue("sound")
 	tokens := f["token"]
 
 	payload := &Payload{
-		Aps: &AlertInfo{Alert: message, Badge: badge, Sound: sound}}
+		Aps: &AlertInfo{Alert: message}}
+	if b := request.FormValue("badge"); len(b) != 0 {
+		if badge, err := strconv.Atoi(b); err != nil {
+			log.Println(err)
+		} else {
+			payload.Aps.Badge = &badge
+		}
+	}
+	if len(sound) != 0 {
+		payload.Aps.Sound = sound
+	}
+	template := Notification{Payload: payload, App: app}
+	var errs ValidationErrors
+	errs.merge(template.LoadFormOptions(f), "")
+	shrinkResult, err := template.Shrink()
+	errs.merge(err, "")
+	errs.merge(template.validateMessage(), "")
+	if shrinkResult.Applied() {
+		w.Header().Set(SHRINK_HEADER, shrinkHeader(shrinkResult))
+	}
+	if len(tokens) == 0 {
+		errs.add("token", RULE_REQUIRED, 0, "token is required")
+	}
+
+	notifications := make([]*Notification, 0, len(tokens))
 	for i := 0; i < len(tokens); i++ {
 		token := tokens[i]
 		tokenSb := sandbox
@@ -106,58 +139,106 @@ func pushHandler2(w http.ResponseWriter, request *http.Request) {
 				tokenApp = app + DEVELOP_SUBFIX
 			}
 		}
-		notification := &Notification{Token: token, Payload: payload, App: tokenApp, Sandbox: tokenSb}
-		messageCN <- notification
+		if err := validateTokenForApp(tokenApp, token); err != nil {
+			err.Field = fmt.Sprintf("token[%d]", i)
+			errs = append(errs, err)
+			continue
+		}
+		notification := template
+		notification.Token = normalizeToken(token)
+		notification.App = tokenApp
+		notification.Sandbox = tokenSb
+		if len(notification.ApnsID) == 0 || len(tokens) > 1 {
+			notification.ApnsID = NewUUID()
+		}
+		notifications = append(notifications, &notification)
+	}
+	if len(errs) != 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if rejected := notifyAll(notifications); rejected != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, fmt.Sprintf("server is busy, %d of %d messages are not accepted", rejected, len(notifications)))
+		return
 	}
 
 	io.WriteString(w, "hello go apns!")
 }
 
 func pushHandler(w http.ResponseWriter, request *http.Request) {
-	p := make([]byte, request.ContentLength)
-	_, err := request.Body.Read(p)
+	p, err := ioutil.ReadAll(request.Body)
 	if err != nil {
 		log.Println("read request body fail")
+		http.Error(w, "read request body fail", http.StatusBadRequest)
+		return
 	}
 	log.Println(string(p))
 	var dict map[string]interface{} = make(map[string]interface{})
 	err = json.Unmarshal(p, &dict)
 	if err != nil {
 		log.Println("error when decode json", err)
-		io.WriteString(w, "error when decode json body")
+		http.Error(w, "error when decode json body", http.StatusBadRequest)
 		return
 	}
 
 	log.Println(dict)
 
-	app := dict["app"].(string)
-
-	sandbox := false
-	if val, ok := dict["sandbox"]; ok {
-		if sb, ok := val.(bool); ok {
-			sandbox = sb
-		}
+	app, ok := dict["app"].(string)
+	if !ok || len(app) == 0 {
+		var errs ValidationErrors
+		errs.add("app", RULE_REQUIRED, 0, "app is required")
+		writeValidationErrors(w, errs)
+		return
 	}
-	payload := dict["payload"].(map[string]interface{})
-
-	if sandbox {
-		app = app + DEVELOP_SUBFIX
+	key := app
+	if sb, ok := dict["sandbox"].(bool); ok && sb {
+		key = app + DEVELOP_SUBFIX
+	}
+	if getPool(key) == nil {
+		http.Error(w, "invalid app", http.StatusNotFound)
+		return
+	}
+	if problem := appUnavailable(key); len(problem) != 0 {
+		http.Error(w, "app is unavailable: "+problem, http.StatusServiceUnavailable)
+		return
 	}
 
-	payloadObj, err := MakePayloadFromMap(payload)
-
+	notifications, shrinkResult, err := MakeNotificationsFromMap(dict, app)
 	if err != nil {
-		io.WriteString(w, "invalid payload format")
+		writeValidationErrors(w, err)
 		return
 	}
-	token := dict["token"]
-	if tk, ok := token.([]interface{}); ok {
-		for t := range tk {
-			message := &Notification{tk[t].(string), &payloadObj, app, sandbox}
-			go Notify(message)
+	if shrinkResult.Applied() {
+		w.Header().Set(SHRINK_HEADER, shrinkHeader(shrinkResult))
+	}
+	if rejected := notifyAll(notifications); rejected != 0 {
+		http.Error(w, fmt.Sprintf("server is busy, %d of %d messages are not accepted", rejected, len(notifications)),
+			http.StatusServiceUnavailable)
+	}
+}
+
+/**
+接收一批消息，返回没有被接收的条数。
+*/
+func notifyAll(notifications []*Notification) int {
+	rejected := 0
+	for _, message := range notifications {
+		RecordStatus(message, STATUS_ACCEPTED, 0, "")
+		if err := Notify(message); err != nil {
+			rejected++
 		}
-	} else {
-		message := &Notification{token.(string), &payloadObj, app, sandbox}
-		go Notify(message)
 	}
+	return rejected
+}
+
+/**
+校验失败时以json返回所有错误，状态码400。
+*/
+func writeValidationErrors(w http.ResponseWriter, err error) {
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		errs = ValidationErrors{{Message: err.Error()}}
+	}
+	writeJson(w, http.StatusBadRequest, map[string]interface{}{"errors": errs})
 }
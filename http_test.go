@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushHandlerRejectsUnavailableApps(t *testing.T) {
+	appConfig = NewConfig()
+	ensurePool("com.a", false)
+	defer removePool("com.a")
+	breakersMutex.Lock()
+	breakerFor("com.a").failures[0] = int(appConfig.CircuitBreakFailures)
+	breakersMutex.Unlock()
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, "com.a")
+		breakersMutex.Unlock()
+	}()
+
+	body := `"token":"` + strings.Repeat("a", 64) + `","payload":{"aps":{"alert":"hi"}}}`
+	for _, c := range []struct {
+		request string
+		status  int
+	}{
+		{`{"app":"com.unknown",` + body, http.StatusNotFound},
+		{`{"app":"com.a",` + body, http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		pushHandler(w, httptest.NewRequest("POST", "/push", strings.NewReader(c.request)))
+		if w.Code != c.status {
+			t.Errorf("%s: got %d %s, want %d", c.request, w.Code, w.Body.String(), c.status)
+		}
+	}
+	if HasPendingMessage("com.a") {
+		t.Error("message is accepted while the circuit is open")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+/**
+* 消息ID的分配。每次建立连接都分配一个新的连接号，该连接上的消息ID从Store中按块预留，
+* 每预留IDENTITY_BLOCK_SIZE个ID才写一次数据库。
+* 消息以app_连接号_ID存档，连接出错时只需重发该连接上出错消息之后分配的ID，
+* 不会误发其他连接或其他应用的消息。
+ */
+
+const IDENTITY_BLOCK_SIZE = 1000
+
+type identityBlock struct {
+	From int32
+	To   int32
+}
+
+type identitySequence struct {
+	number int32 // 连接号
+	mutex  sync.Mutex
+	blocks []identityBlock // 已预留的ID，按分配顺序排列
+	last   int32           // 最近分配的ID
+}
+
+func newIdentitySequence() *identitySequence {
+	return &identitySequence{number: incrCounter(CONNECTION_NUM_KEY, 1)}
+}
+
+/**
+预留一块ID。计数器超出int32从头开始时，不足一块的部分跳过。
+*/
+func reserveIdentityBlock() identityBlock {
+	to := incrCounter(LATEST_IDENTITY_KEY, IDENTITY_BLOCK_SIZE)
+	if to < IDENTITY_BLOCK_SIZE {
+		to = incrCounter(LATEST_IDENTITY_KEY, IDENTITY_BLOCK_SIZE)
+	}
+	if to < IDENTITY_BLOCK_SIZE {
+		log.Println("can not reserve identity block, got", to)
+		to = IDENTITY_BLOCK_SIZE
+	}
+	return identityBlock{to - IDENTITY_BLOCK_SIZE + 1, to}
+}
+
+func (seq *identitySequence) Next() int32 {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+	if len(seq.blocks) == 0 || seq.last == seq.blocks[len(seq.blocks)-1].To {
+		block := reserveIdentityBlock()
+		seq.blocks = append(seq.blocks, block)
+		seq.last = block.From
+		return seq.last
+	}
+	seq.last++
+	return seq.last
+}
+
+/**
+该连接在id之后分配的所有ID，按分配顺序排列。id不是该连接分配的时返回nil。
+*/
+func (seq *identitySequence) After(id int32) []int32 {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+	var result []int32
+	found := false
+	for i, block := range seq.blocks {
+		to := block.To
+		if i == len(seq.blocks)-1 {
+			to = seq.last
+		}
+		if !found {
+			if id < block.From || id > to {
+				continue
+			}
+			found = true
+			for next := id + 1; next <= to; next++ {
+				result = append(result, next)
+			}
+			continue
+		}
+		for next := block.From; next <= to; next++ {
+			result = append(result, next)
+		}
+	}
+	if !found {
+		log.Printf("message %d was not sent by connection %d", id, seq.number)
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIdentitySequenceAfter(t *testing.T) {
+	appConfig = NewConfig()
+	store = NewMemoryStore()
+	defer closeStore()
+
+	seq, other := newIdentitySequence(), newIdentitySequence()
+	if seq.number == other.number {
+		t.Fatal("connections share the same number")
+	}
+	// 两个连接交替预留ID块，seq的ID不连续
+	var ids []int32
+	for i := 0; i < IDENTITY_BLOCK_SIZE+2; i++ {
+		ids = append(ids, seq.Next())
+		if i%500 == 0 {
+			other.Next()
+		}
+	}
+	if len(seq.blocks) != 2 || seq.blocks[1].From == seq.blocks[0].To+1 {
+		t.Fatalf("blocks are %+v", seq.blocks)
+	}
+
+	if got := seq.After(ids[IDENTITY_BLOCK_SIZE-3]); !reflect.DeepEqual(got, ids[IDENTITY_BLOCK_SIZE-2:]) {
+		t.Fatalf("after %d: got %v, want %v", ids[IDENTITY_BLOCK_SIZE-3], got, ids[IDENTITY_BLOCK_SIZE-2:])
+	}
+	if got := seq.After(ids[0]); !reflect.DeepEqual(got, ids[1:]) {
+		t.Fatalf("after the first id: got %d ids", len(got))
+	}
+	if got := seq.After(ids[len(ids)-1]); len(got) != 0 {
+		t.Fatalf("after the last id: got %v", got)
+	}
+	if got := seq.After(other.blocks[0].From); got != nil {
+		t.Fatalf("id of another connection: got %v", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/redis.v2"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+* 失效token的导出：
+* - GET /v2/apps/<app>/invalid-tokens 分页查询
+* - app.json中BadTokenQueue为true时，新发现的失效token会LPUSH到Redis的goapns:badtoken:<app>
+ */
+
+const (
+	BAD_TOKEN_QUEUE_PREFIX     = "goapns:badtoken:"
+	BAD_TOKEN_QUEUE_MAX_LENGTH = 100000
+
+	DEFAULT_INVALID_TOKEN_LIMIT = 100
+	MAX_INVALID_TOKEN_LIMIT     = 1000
+)
+
+var badTokenQueueClient *redis.Client
+var badTokenQueueMutex sync.Mutex
+
+type InvalidToken struct {
+	Token     string `json:"token"`
+	InvalidAt int64  `json:"invalid_at"` // 失效时间，旧版本记录的bad token为1
+	Sandbox   bool   `json:"sandbox"`
+}
+
+/**
+按token的顺序列出app的失效token，从cursor之后开始，只返回since之后失效的，最多limit个。
+还有更多结果时返回下一页的cursor。
+*/
+func listInvalidTokens(app string, since int64, cursor string, limit int) ([]*InvalidToken, string) {
+	prefix := BAD_TOKEN_PREFIX + app + "_"
+	sandbox := strings.HasSuffix(app, DEVELOP_SUBFIX)
+	result := make([]*InvalidToken, 0, limit)
+	next := ""
+	scanRecords(prefix, func(key string, value []byte) bool {
+		token := strings.TrimPrefix(key, prefix)
+		// 生产环境的前缀也能匹配到sandbox的key（app_dev_token），跳过。
+		if strings.Contains(token, "_") || token <= cursor {
+			return true
+		}
+		invalidAt := parseBadTokenTime(value)
+		if invalidAt < since {
+			return true
+		}
+		if len(result) == limit {
+			next = result[len(result)-1].Token
+			return false
+		}
+		result = append(result, &InvalidToken{token, invalidAt, sandbox})
+		return true
+	})
+	return result, next
+}
+
+/**
+GET /v2/apps/<app>/invalid-tokens?sandbox=&since=&cursor=&limit=
+*/
+func invalidTokensHandler(w http.ResponseWriter, request *http.Request, app string) {
+	if request.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	if sb := request.FormValue("sandbox"); sb == "1" || sb == "true" {
+		app = app + DEVELOP_SUBFIX
+	}
+	var since int64
+	if value := request.FormValue("since"); len(value) != 0 {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			writeValidationErrors(w, ValidationErrors{{"since", RULE_TYPE, 0, "since should be a unix timestamp"}})
+			return
+		}
+	}
+	limit, err := strconv.Atoi(request.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = DEFAULT_INVALID_TOKEN_LIMIT
+	}
+	if limit > MAX_INVALID_TOKEN_LIMIT {
+		limit = MAX_INVALID_TOKEN_LIMIT
+	}
+	tokens, next := listInvalidTokens(app, since, request.FormValue("cursor"), limit)
+	response := map[string]interface{}{"tokens": tokens}
+	if len(next) != 0 {
+		response["next_cursor"] = next
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+/**
+把新发现的失效token推到Redis队列，供应用的后台消费。
+*/
+func publishBadToken(app string, token string, invalidAt int64) {
+	bundle := strings.Replace(app, DEVELOP_SUBFIX, "", 1)
+	if !loadAppOptions(bundle).BadTokenQueue {
+		return
+	}
+	data, err := json.Marshal(&InvalidToken{token, invalidAt, strings.HasSuffix(app, DEVELOP_SUBFIX)})
+	if err != nil {
+		log.Println("can not encode bad token", err)
+		return
+	}
+
+	badTokenQueueMutex.Lock()
+	if badTokenQueueClient == nil {
+		badTokenQueueClient = newRedisClient()
+	}
+	cli := badTokenQueueClient
+	badTokenQueueMutex.Unlock()
+
+	key := BAD_TOKEN_QUEUE_PREFIX + bundle
+	if err := cli.LPush(key, string(data)).Err(); err != nil {
+		log.Printf("can not push bad token to %s: %s", key, err)
+		return
+	}
+	// 没人消费时队列不能无限增长，丢弃最旧的。
+	if err := cli.LTrim(key, 0, BAD_TOKEN_QUEUE_MAX_LENGTH-1).Err(); err != nil {
+		log.Printf("can not trim %s: %s", key, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+/**
+* 证书及私钥的加载，支持以下几种形式：
+* - cer.pem + 未加密的key.pem
+* - cer.pem + 加密的key.pem（openssl的传统加密格式或PKCS#8加密格式）
+* - 从钥匙串导出的.p12文件（没有cer.pem时使用）
+* 密码在app.json的Passphrase中填写，或用PassphraseEnv指定从哪个环境变量读取。
+ */
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+/**
+在目录中查找.p12文件，找不到时返回空字符串。
+*/
+func findP12(dir string) string {
+	matches, err := filepath.Glob(path.Join(dir, "*"+P12_FILE_SUFFIX))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+/**
+应用证书的密码，app.json中的Passphrase优先，其次为PassphraseEnv指定的环境变量。
+*/
+func appPassphrase(options AppOptions) string {
+	if len(options.Passphrase) != 0 {
+		return options.Passphrase
+	}
+	if len(options.PassphraseEnv) != 0 {
+		return os.Getenv(options.PassphraseEnv)
+	}
+	return ""
+}
+
+/**
+加载应用的证书及私钥，app为bundle id。certFile不存在时使用同一目录下的.p12文件。
+*/
+func loadCertificate(app string, certFile string, keyFile string) (tls.Certificate, error) {
+	passphrase := appPassphrase(loadAppOptions(app))
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if p12File := findP12(path.Dir(certFile)); len(p12File) != 0 {
+			return loadP12(p12File, passphrase)
+		}
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err = decryptKeyPEM(keyPEM, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can not decrypt %s: %s", keyFile, err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func loadP12(p12File string, passphrase string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(p12File)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(data, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can not decode %s: %s", p12File, err)
+	}
+	pair := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	for _, ca := range chain {
+		pair.Certificate = append(pair.Certificate, ca.Raw)
+	}
+	return pair, nil
+}
+
+/**
+解密key.pem中的私钥，未加密的私钥原样返回。
+*/
+func decryptKeyPEM(keyPEM []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return keyPEM, nil
+	}
+	var der []byte
+	var err error
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, errors.New("key is encrypted but no passphrase is given")
+		}
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, errors.New("key is encrypted but no passphrase is given")
+		}
+		der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+		block = &pem.Block{Type: block.Type, Bytes: der}
+	default:
+		return keyPEM, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkixAlgorithm
+	EncryptedData []byte
+}
+
+type pkixAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkixAlgorithm
+	EncryptionScheme  pkixAlgorithm
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int           `asn1:"optional"`
+	PRF            pkixAlgorithm `asn1:"optional"`
+}
+
+/**
+解密PKCS#8格式的加密私钥，只支持openssl默认使用的PBES2（PBKDF2 + AES/3DES-CBC）。
+*/
+func decryptPKCS8(data []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PRF %s", kdf.PRF.Algorithm)
+	}
+
+	var keyLength int
+	var newCipher func(key []byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme %s", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.IterationCount, keyLength, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted key")
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// 去掉PKCS#7填充，填充不对说明密码错误
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errors.New("wrong passphrase")
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("wrong passphrase")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
@@ -4,46 +4,149 @@ import (
 	"container/list"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"log"
-	"path"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type AlertObject struct {
-	Body               string      `json:"body,omitempty"`
-	ActionLocalizedKey string      `json:"action-loc-key,omitempty"`
-	LocalizedKey       string      `json:"loc-key,omitempty"`
-	LocalizedArguments interface{} `json:"loc-args,omitempty"`
-	LaunchImage        string      `json:"launch-image,omitempty"`
+	Title              string   `json:"title,omitempty"`
+	Subtitle           string   `json:"subtitle,omitempty"`
+	Body               string   `json:"body,omitempty"`
+	LaunchImage        string   `json:"launch-image,omitempty"`
+	TitleLocalizedKey  string   `json:"title-loc-key,omitempty"`
+	TitleLocalizedArgs []string `json:"title-loc-args,omitempty"`
+	SubtitleLocKey     string   `json:"subtitle-loc-key,omitempty"`
+	SubtitleLocArgs    []string `json:"subtitle-loc-args,omitempty"`
+	ActionLocalizedKey string   `json:"action-loc-key,omitempty"`
+	LocalizedKey       string   `json:"loc-key,omitempty"`
+	LocalizedArguments []string `json:"loc-args,omitempty"`
+	SummaryArg         string   `json:"summary-arg,omitempty"`
+	SummaryArgCount    int      `json:"summary-arg-count,omitempty"`
 }
 
 func (alert *AlertObject) IsEmpty() bool {
-	return len(alert.Body) == 0 && len(alert.ActionLocalizedKey) == 0 &&
-		len(alert.LocalizedKey) == 0 && alert.LocalizedArguments == nil &&
-		len(alert.LaunchImage) == 0
+	return len(alert.Title) == 0 && len(alert.Subtitle) == 0 && len(alert.Body) == 0 &&
+		len(alert.LaunchImage) == 0 && len(alert.TitleLocalizedKey) == 0 &&
+		len(alert.TitleLocalizedArgs) == 0 && len(alert.SubtitleLocKey) == 0 &&
+		len(alert.SubtitleLocArgs) == 0 && len(alert.ActionLocalizedKey) == 0 &&
+		len(alert.LocalizedKey) == 0 && len(alert.LocalizedArguments) == 0 &&
+		len(alert.SummaryArg) == 0 && alert.SummaryArgCount == 0
+}
+
+/**
+* critical alert的声音设置
+ */
+type SoundObject struct {
+	Critical int     `json:"critical,omitempty"`
+	Name     string  `json:"name,omitempty"`
+	Volume   float64 `json:"volume,omitempty"`
+}
+
+func (sound *SoundObject) IsEmpty() bool {
+	return sound.Critical == 0 && len(sound.Name) == 0 && sound.Volume == 0
 }
 
 type AlertInfo struct {
-	Alert interface{} `json:"alert,omitempty"`
-	Badge int         `json:"badge,omitempty,int"`
-	Sound string      `json:"sound,omitempty"`
+	Alert             interface{} `json:"alert,omitempty"` // string或AlertObject
+	Badge             *int        `json:"badge,omitempty"`
+	Sound             interface{} `json:"sound,omitempty"` // string或SoundObject
+	ContentAvailable  int         `json:"content-available,omitempty"`
+	MutableContent    int         `json:"mutable-content,omitempty"`
+	Category          string      `json:"category,omitempty"`
+	ThreadID          string      `json:"thread-id,omitempty"`
+	TargetContentID   string      `json:"target-content-id,omitempty"`
+	InterruptionLevel string      `json:"interruption-level,omitempty"` // passive, active, time-sensitive, critical
+	RelevanceScore    float64     `json:"relevance-score,omitempty"`
+	FilterCriteria    string      `json:"filter-criteria,omitempty"`
+
+	// Live Activity
+	Timestamp      int64                  `json:"timestamp,omitempty"`
+	Event          string                 `json:"event,omitempty"` // start, update, end
+	ContentState   map[string]interface{} `json:"content-state,omitempty"`
+	AttributesType string                 `json:"attributes-type,omitempty"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	StaleDate      int64                  `json:"stale-date,omitempty"`
+	DismissalDate  int64                  `json:"dismissal-date,omitempty"`
 }
 
-func (info *AlertInfo) IsEmpty() bool {
-	if info.Alert != nil {
-		if inst, ok := info.Alert.(AlertObject); ok {
-			if inst.IsEmpty() {
-				return info.Badge == 0 && len(info.Sound) == 0
-			}
+/**
+带有Live Activity字段的aps即为Live Activity的推送。
+*/
+func (info *AlertInfo) IsLiveActivity() bool {
+	return info != nil && (info.Timestamp != 0 || len(info.Event) != 0 ||
+		info.ContentState != nil || len(info.AttributesType) != 0 || info.Attributes != nil ||
+		info.StaleDate != 0 || info.DismissalDate != 0)
+}
+
+func (info *AlertInfo) ValidateLiveActivity() error {
+	var errs ValidationErrors
+	if info.Timestamp == 0 {
+		errs.add("aps.timestamp", RULE_REQUIRED, 0, "live activity payload requires timestamp")
+	}
+	switch info.Event {
+	case "":
+		errs.add("aps.event", RULE_REQUIRED, 0, "live activity payload requires event")
+	case LIVE_ACTIVITY_EVENT_START:
+		if len(info.AttributesType) == 0 {
+			errs.add("aps.attributes-type", RULE_REQUIRED, 0, "live activity start event requires attributes-type")
 		}
-	} else {
-		return info.Badge == 0 && len(info.Sound) == 0
+		if info.Attributes == nil {
+			errs.add("aps.attributes", RULE_REQUIRED, 0, "live activity start event requires attributes")
+		}
+		fallthrough
+	case LIVE_ACTIVITY_EVENT_UPDATE:
+		if info.ContentState == nil {
+			errs.add("aps.content-state", RULE_REQUIRED, 0, "live activity %s event requires content-state", info.Event)
+		}
+	case LIVE_ACTIVITY_EVENT_END:
+	default:
+		errs.add("aps.event", RULE_ENUM, 0, "unknown live activity event %s", info.Event)
+	}
+	return errs.err()
+}
+
+func (info *AlertInfo) alertIsEmpty() bool {
+	switch alert := info.Alert.(type) {
+	case nil:
+		return true
+	case string:
+		return len(alert) == 0
+	case AlertObject:
+		return alert.IsEmpty()
+	}
+	return false
+}
+
+func (info *AlertInfo) soundIsEmpty() bool {
+	switch sound := info.Sound.(type) {
+	case nil:
+		return true
+	case string:
+		return len(sound) == 0
+	case SoundObject:
+		return sound.IsEmpty()
 	}
 	return false
 }
 
+/**
+没有提示、角标、声音，也不是静默推送时，消息对用户没有任何作用。
+*/
+func (info *AlertInfo) IsEmpty() bool {
+	if info == nil {
+		return true
+	}
+	return info.alertIsEmpty() && info.Badge == nil && info.soundIsEmpty() &&
+		info.ContentAvailable == 0 && !info.IsLiveActivity()
+}
+
 type Payload struct {
 	Aps    *AlertInfo             `json:"aps,omitempty"`
 	Custom map[string]interface{} `json:"custom,omitempty"`
@@ -66,6 +169,10 @@ func TruncateString(s string, byteLength int) string {
 	return result
 }
 
+func (payload *Payload) IsLiveActivity() bool {
+	return payload.Aps.IsLiveActivity()
+}
+
 func (payload *Payload) IsEmpty() bool {
 	return payload.Aps.IsEmpty() && payload.Custom == nil
 }
@@ -85,32 +192,11 @@ func (payload *Payload) rawJson() ([]byte, error) {
 	return data, nil
 }
 
+/**
+payload的json。超出大小限制的payload应在进入推送队列前用Shrink压缩。
+*/
 func (payload *Payload) Json() ([]byte, error) {
-	json, err := payload.rawJson()
-	if err != nil {
-		return json, err
-	}
-
-	if l := len(json) - 256; l > 0 {
-		if inst, ok := payload.Aps.Alert.(AlertObject); ok {
-			alert := inst.Body
-			// if len(alert) < l {
-			// 	return json, errors.New("payload too large")
-			// }
-			inst.Body = TruncateString(alert, l)
-			payload.Aps.Alert = inst
-		} else {
-			alert := payload.Aps.Alert.(string)
-			// if len(alert) < l {
-			// 	return json, errors.New("payload too large")
-			// }
-			payload.Aps.Alert = TruncateString(alert, l)
-		}
-		json, err = payload.rawJson()
-		return json, err
-	} else {
-		return json, err
-	}
+	return payload.rawJson()
 }
 
 func MakePayloadFromString(str string) (payload Payload, e error) {
@@ -138,43 +224,276 @@ func MakePayloadFromMap(dict map[string]interface{}) (payload Payload, e error)
 
 	bytes, err := json.Marshal(dict)
 	if err != nil {
-		return payload, err
 		log.Println(err)
+		return payload, err
 	}
 
 	err = json.Unmarshal(bytes, &payload)
 	if err != nil {
-		return payload, err
 		log.Println(err)
+		return payload, err
+	}
+	if payload.Aps == nil {
+		payload.Aps = &AlertInfo{}
 	}
 	if reflect.ValueOf(payload.Aps.Alert).Kind() == reflect.Map {
-		bytes, err := json.Marshal(payload.Aps.Alert)
-		log.Println(string(bytes))
-		if err != nil {
-			return payload, err
+		var obj AlertObject
+		if err = convertMap(payload.Aps.Alert, &obj); err != nil {
 			log.Println(err)
+			return payload, validationErrorFromJson(err, "aps.alert")
+		}
+		payload.Aps.Alert = obj
+	}
+	if reflect.ValueOf(payload.Aps.Sound).Kind() == reflect.Map {
+		var obj SoundObject
+		if err = convertMap(payload.Aps.Sound, &obj); err != nil {
+			log.Println(err)
+			return payload, validationErrorFromJson(err, "aps.sound")
+		}
+		payload.Aps.Sound = obj
+	}
+	return payload, nil
+}
+
+/**
+把json解出来的map转换成对应的结构体。
+*/
+func convertMap(value interface{}, obj interface{}) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, obj)
+}
+
+/**
+把/push接口或redis队列中的json转换成消息，每个token一条。
+超出大小的payload按应用的策略压缩，所有参数都会先校验，有任何错误时返回ValidationErrors，不产生任何消息。
+*/
+func MakeNotificationsFromMap(dict map[string]interface{}, app string) ([]*Notification, *ShrinkResult, error) {
+	var errs ValidationErrors
+	template, shrinkResult, err := MakeNotificationTemplate(dict, app)
+	errs.merge(err, "")
+
+	fields, tokens, tokenErr := tokensFromMap(dict)
+	if tokenErr != nil {
+		errs = append(errs, tokenErr)
+	}
+	notifications := make([]*Notification, 0, len(tokens))
+	for i, token := range tokens {
+		message, err := template.ForToken(fields[i], token, len(tokens))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		notifications = append(notifications, message)
+	}
+	if len(errs) != 0 {
+		return nil, shrinkResult, errs
+	}
+	return notifications, shrinkResult, nil
+}
+
+/**
+从json中生成除token外的消息模板，同一请求的所有token共用。
+*/
+func MakeNotificationTemplate(dict map[string]interface{}, app string) (*Notification, *ShrinkResult, error) {
+	var errs ValidationErrors
+	sandbox := false
+	if val, ok := dict["sandbox"]; ok {
+		if sb, ok := val.(bool); ok {
+			sandbox = sb
 		} else {
-			var obj AlertObject
-			err := json.Unmarshal(bytes, &obj)
-			if err != nil {
-				return payload, err
-				log.Println(err)
-			}
+			errs.add("sandbox", RULE_TYPE, 0, "sandbox should be a boolean")
+		}
+	}
+	if sandbox && !strings.HasSuffix(app, DEVELOP_SUBFIX) {
+		app = app + DEVELOP_SUBFIX
+	}
 
-			payload.Aps.Alert = obj
+	var payload Payload
+	if payloadDict, ok := dict["payload"].(map[string]interface{}); ok {
+		var err error
+		payload, err = MakePayloadFromMap(payloadDict)
+		if err != nil {
+			errs.merge(validationErrorFromJson(err, "payload"), "")
 		}
+	} else {
+		errs.add("payload", RULE_REQUIRED, 0, "payload should be a dictionary")
 	}
-	return payload, nil
+
+	template := &Notification{Payload: &payload, App: app, Sandbox: sandbox}
+	errs.merge(template.LoadOptions(dict), "")
+	var shrinkResult *ShrinkResult
+	if len(errs) == 0 {
+		var err error
+		shrinkResult, err = template.Shrink()
+		errs.merge(err, "")
+	}
+	if len(errs) == 0 {
+		errs.merge(template.validateMessage(), "")
+	}
+	return template, shrinkResult, errs.err()
+}
+
+/**
+token可以是一个字符串或字符串列表，返回每个token在请求中的字段路径及其值。
+*/
+func tokensFromMap(dict map[string]interface{}) ([]string, []interface{}, *ValidationError) {
+	switch token := dict["token"].(type) {
+	case nil:
+		return nil, nil, &ValidationError{"token", RULE_REQUIRED, 0, "token is required"}
+	case []interface{}:
+		fields := make([]string, len(token))
+		for i := range token {
+			fields[i] = fmt.Sprintf("token[%d]", i)
+		}
+		return fields, token, nil
+	default:
+		return []string{"token"}, []interface{}{token}, nil
+	}
+}
+
+/**
+以模板为基础生成发给某个token的消息。每条消息都有自己的apns-id作为消息ID，
+调用方指定的apns_id只在只有一个token时使用。
+*/
+func (template *Notification) ForToken(field string, value interface{}, count int) (*Notification, *ValidationError) {
+	token, ok := value.(string)
+	if !ok {
+		return nil, &ValidationError{field, RULE_TYPE, 0, "token should be a string"}
+	}
+	if err := validateTokenForApp(template.App, token); err != nil {
+		err.Field = field
+		return nil, err
+	}
+	message := *template
+	message.Token = normalizeToken(token)
+	if len(message.ApnsID) == 0 || count > 1 {
+		message.ApnsID = NewUUID()
+	}
+	return &message, nil
 }
 
 /**
 * 要推送给用户的消息
  */
 type Notification struct {
-	Token   string
-	Payload *Payload
-	App     string
-	Sandbox bool
+	Token      string
+	Payload    *Payload
+	App        string
+	Sandbox    bool
+	Expiry     int64  // 过期时间(unix时间戳)，0为默认的一天后过期，负数表示只尝试投递一次
+	Priority   int    // 10为立即发送，5为省电模式发送，0为默认值10
+	PushType   string // apns-push-type，如alert、background、voip
+	CollapseID string // apns-collapse-id，相同ID的消息在设备上只显示最新一条
+	Topic      string // apns-topic，为空时根据应用及PushType生成
+	ApnsID     string // apns-id，为空时由苹果生成
+	Retries    int    // HTTP/2通道因限流、服务器出错或provider token过期重发的次数
+}
+
+/**
+从推送请求（/push接口或redis队列中的json）中读取消息的可选参数，参数类型不对时返回ValidationErrors。
+*/
+func (notification *Notification) LoadOptions(dict map[string]interface{}) error {
+	var errs ValidationErrors
+	if value, ok := dict["expiry"]; ok {
+		if expiry, ok := value.(float64); ok {
+			notification.Expiry = int64(expiry)
+		} else {
+			errs.add("expiry", RULE_TYPE, 0, "expiry should be a unix timestamp")
+		}
+	}
+	if value, ok := dict["priority"]; ok {
+		if priority, ok := value.(float64); ok {
+			notification.Priority = int(priority)
+		} else {
+			errs.add("priority", RULE_TYPE, 0, "priority should be a number")
+		}
+	}
+	for key, field := range map[string]*string{
+		"push_type":   &notification.PushType,
+		"collapse_id": &notification.CollapseID,
+		"topic":       &notification.Topic,
+		"apns_id":     &notification.ApnsID,
+	} {
+		if value, ok := dict[key]; ok {
+			if str, ok := value.(string); ok {
+				*field = str
+			} else {
+				errs.add(key, RULE_TYPE, 0, "%s should be a string", key)
+			}
+		}
+	}
+	notification.applyDefaults()
+	return errs.err()
+}
+
+/**
+从/push2接口的表单中读取消息的可选参数。
+*/
+func (notification *Notification) LoadFormOptions(form url.Values) error {
+	var errs ValidationErrors
+	if value := form.Get("expiry"); len(value) != 0 {
+		expiry, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.add("expiry", RULE_TYPE, 0, "expiry should be a unix timestamp")
+		}
+		notification.Expiry = expiry
+	}
+	if value := form.Get("priority"); len(value) != 0 {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("priority", RULE_TYPE, 0, "priority should be a number")
+		}
+		notification.Priority = priority
+	}
+	notification.PushType = form.Get("push_type")
+	notification.CollapseID = form.Get("collapse_id")
+	notification.Topic = form.Get("topic")
+	notification.ApnsID = form.Get("apns_id")
+	notification.applyDefaults()
+	return errs.err()
+}
+
+/**
+Live Activity的推送必须使用liveactivity类型，topic为<bundle>.push-type.liveactivity，
+未指定类型时自动设置。
+*/
+func (notification *Notification) applyDefaults() {
+	if len(notification.PushType) == 0 && notification.Payload != nil && notification.Payload.IsLiveActivity() {
+		notification.PushType = PUSH_TYPE_LIVEACTIVITY
+	}
+}
+
+/**
+apns-topic：未指定时为应用的bundle id，加上PushType要求的后缀，如voip推送为<bundle>.voip。
+*/
+func (notification *Notification) TopicValue() string {
+	if len(notification.Topic) != 0 {
+		return notification.Topic
+	}
+	return strings.Replace(notification.App, DEVELOP_SUBFIX, "", 1) + PUSH_TYPE_TOPIC_SUFFIX[notification.PushType]
+}
+
+/**
+消息实际的过期时间，0表示不存储、只尝试投递一次。
+*/
+func (notification *Notification) ExpiryTime() int64 {
+	if notification.Expiry == 0 {
+		return time.Now().AddDate(0, 0, 1).Unix()
+	}
+	if notification.Expiry < 0 {
+		return 0
+	}
+	return notification.Expiry
+}
+
+func (notification *Notification) PriorityValue() int {
+	if notification.Priority == 0 {
+		return APNS_PRIORITY_IMMEDIATELY
+	}
+	return notification.Priority
 }
 
 /**
@@ -185,8 +504,17 @@ type APNSRespone struct {
 	Status     byte
 	Identifier int32
 	Connection *tls.Conn
+	sequence   *identitySequence // 出错的连接
 	App        string
 	Sandbox    bool
+
+	// 以下字段只有HTTP/2通道才会填充
+	Transport     string        // 产生该错误的通道
+	HttpStatus    int           // HTTP状态码，0表示请求根本没有发出去
+	Timestamp     int64         // 410时苹果确认token失效的时间，unix时间戳，毫秒
+	Reason        string        // 苹果返回的错误原因，如BadDeviceToken
+	Notification  *Notification // 发送失败的那条消息
+	providerToken string        // 请求使用的provider token，证书认证时为空
 }
 
 type AppConfig struct {
@@ -195,26 +523,76 @@ type AppConfig struct {
 	DbPath             string `json:",omitempty"`
 	ConnectionIdleSecs int64  `json:",omitempty"`
 
+	StoreBackend string `json:",omitempty"` // 存储后端：leveldb、bolt、memory或redis
+	DbCacheMB    int64  `json:",omitempty"` // leveldb的LRU缓存大小，单位MB
+
+	ArchiveMaxAgeSecs   int64 `json:",omitempty"` // 消息存档的保留时长
+	ArchiveMaxPerApp    int64 `json:",omitempty"` // 每个应用最多保留的存档条数，0为不限
+	CompactIntervalSecs int64 `json:",omitempty"` // 清理存档的间隔，0为不清理
+
+	FeedbackIntervalSecs  int64 `json:",omitempty"` // 收取feedback的间隔，0为不收取
+	AppReloadIntervalSecs int64 `json:",omitempty"` // 扫描AppsDir的间隔，0为不热加载
+	StrictCertificates    bool  `json:",omitempty"` // 有证书过期或无效时拒绝启动
+
+	ConnectionsPerApp   int64  `json:",omitempty"` // 每个应用（sandbox单独计算）的连接数
+	PoolStrategy        string `json:",omitempty"` // 消息分配到连接的策略：round-robin或least-inflight
+	ConnectionQueueSize int64  `json:",omitempty"` // 每个连接的发送队列长度
+	Http2MaxStreams     int64  `json:",omitempty"` // 每个HTTP/2连接同时进行的请求数
+
+	ReconnectMaxSecs     int64 `json:",omitempty"` // 重连的最大间隔
+	CircuitBreakFailures int64 `json:",omitempty"` // 连续失败多少次后熔断，0为不熔断
+	PendingBufferSize    int64 `json:",omitempty"` // 每个应用等待发送的消息上限，0为不限
+
+	TLSCAFile string   `json:",omitempty"` // 校验苹果服务器证书用的根证书，为空时使用系统的根证书
+	TLSPins   []string `json:",omitempty"` // 苹果服务器证书链中公钥的SHA-256，base64编码
+
+	DefaultTransport     string `json:",omitempty"` // 应用未指定时使用的通道：binary或http2
+	Http2Endpoint        string `json:",omitempty"`
+	Http2SandboxEndpoint string `json:",omitempty"`
+
+	Shrink ShrinkOptions // payload超出大小时的压缩策略
+
 	QueueWithRedis bool   `json:",omitempty"`
 	RedisHost      string `json:",omitempty"`
 	RedisPort      int64  `json:",omitempty"`
 	RedisDB        int64  `json:",omitempty"`
 	RedisPassword  string `json:",omitempty"`
 	RedisPoolsize  int64  `json:",omitempty"`
+
+	RedisArchiveTTLSecs int64 `json:",omitempty"` // redis存储时消息存档的保留时长，0为不过期
 }
 
 func NewConfig() AppConfig {
 	return AppConfig{
-		AppsDir:            "/etc/goapns/apps",
-		AppPort:            9872,
-		DbPath:             "/etc/goapns/db",
-		ConnectionIdleSecs: 600,
-		QueueWithRedis:     false,
-		RedisHost:          "localhost",
-		RedisPort:          6379,
-		RedisDB:            0,
-		RedisPassword:      "",
-		RedisPoolsize:      10,
+		AppsDir:               "/etc/goapns/apps",
+		AppPort:               9872,
+		DbPath:                "/etc/goapns/db",
+		ConnectionIdleSecs:    600,
+		ConnectionsPerApp:     1,
+		PoolStrategy:          POOL_ROUND_ROBIN,
+		ConnectionQueueSize:   1000,
+		Http2MaxStreams:       100,
+		ReconnectMaxSecs:      300,
+		CircuitBreakFailures:  5,
+		PendingBufferSize:     10000,
+		StoreBackend:          STORE_LEVELDB,
+		DbCacheMB:             3072,
+		ArchiveMaxAgeSecs:     86400,
+		ArchiveMaxPerApp:      100000,
+		CompactIntervalSecs:   3600,
+		FeedbackIntervalSecs:  3600,
+		AppReloadIntervalSecs: 10,
+		DefaultTransport:      TRANSPORT_BINARY,
+		Http2Endpoint:         APNS_HTTP2_ENDPOINT,
+		Http2SandboxEndpoint:  APNS_HTTP2_SANDBOX_ENDPOINT,
+		Shrink:                NewShrinkOptions(),
+		QueueWithRedis:        false,
+		RedisHost:             "localhost",
+		RedisPort:             6379,
+		RedisDB:               0,
+		RedisPassword:         "",
+		RedisPoolsize:         10,
+		RedisArchiveTTLSecs:   86400,
 	}
 }
 
@@ -224,6 +602,30 @@ func (appConfig *AppConfig) Display() {
 	appPort:%d
 	dbPath:%s
 	connectionIdleSesc:%d
+	storeBackend:%s
+	dbCacheMB:%d
+	archiveMaxAgeSecs:%d
+	archiveMaxPerApp:%d
+	compactIntervalSecs:%d
+	feedbackIntervalSecs:%d
+	appReloadIntervalSecs:%d
+	strictCertificates:%t
+
+	connectionsPerApp:%d
+	poolStrategy:%s
+	connectionQueueSize:%d
+	http2MaxStreams:%d
+	reconnectMaxSecs:%d
+	circuitBreakFailures:%d
+	pendingBufferSize:%d
+
+	tlsCAFile:%s
+	tlsPins:%v
+
+	defaultTransport:%s
+	http2Endpoint:%s
+	http2SandboxEndpoint:%s
+	shrink:%+v
 
 	queueWithRedis:%t
 
@@ -231,61 +633,139 @@ func (appConfig *AppConfig) Display() {
 	redisPort:%d
 	redisDB:%d
 	redisPassword:hidden, (%d)chars
-	redisPoolsize:%d`
+	redisPoolsize:%d
+	redisArchiveTTLSecs:%d`
 	log.Printf(format, appConfig.AppsDir, appConfig.AppPort, appConfig.DbPath, appConfig.ConnectionIdleSecs,
+		appConfig.StoreBackend, appConfig.DbCacheMB,
+		appConfig.ArchiveMaxAgeSecs, appConfig.ArchiveMaxPerApp, appConfig.CompactIntervalSecs,
+		appConfig.FeedbackIntervalSecs, appConfig.AppReloadIntervalSecs,
+		appConfig.StrictCertificates,
+		appConfig.ConnectionsPerApp, appConfig.PoolStrategy, appConfig.ConnectionQueueSize,
+		appConfig.Http2MaxStreams,
+		appConfig.ReconnectMaxSecs, appConfig.CircuitBreakFailures, appConfig.PendingBufferSize,
+		appConfig.TLSCAFile, appConfig.TLSPins,
+		appConfig.DefaultTransport, appConfig.Http2Endpoint, appConfig.Http2SandboxEndpoint,
+		appConfig.Shrink,
 		appConfig.QueueWithRedis, appConfig.RedisHost, appConfig.RedisPort, appConfig.RedisDB,
-		len(appConfig.RedisPassword), appConfig.RedisPoolsize)
+		len(appConfig.RedisPassword), appConfig.RedisPoolsize, appConfig.RedisArchiveTTLSecs)
+}
+
+/**
+* 每个应用目录下可选的app.json，用于覆盖该应用的默认行为
+ */
+type AppOptions struct {
+	Transport     string          `json:",omitempty"` // binary或http2，为空时使用AppConfig.DefaultTransport
+	Shrink        *ShrinkOptions  `json:",omitempty"` // payload压缩策略，为空时使用AppConfig.Shrink
+	TeamID        string          `json:",omitempty"` // Token认证时必填
+	KeyID         string          `json:",omitempty"` // Token认证的密钥ID，为空时从AuthKey_<KeyID>.p8文件名中取得
+	Passphrase    string          `json:",omitempty"` // .p12或加密的key.pem的密码
+	PassphraseEnv string          `json:",omitempty"` // 从该环境变量读取密码，Passphrase为空时使用
+	Webhooks      []WebhookConfig `json:",omitempty"` // 投递结果回调
+
+	Connections  int64  `json:",omitempty"` // 该应用的连接数，为0时使用AppConfig.ConnectionsPerApp
+	PoolStrategy string `json:",omitempty"` // 为空时使用AppConfig.PoolStrategy
+
+	BadTokenQueue bool `json:",omitempty"` // 把新发现的失效token推到Redis的goapns:badtoken:<app>
 }
 
 /**
-* 从本地到apple APNS服务器的Socket连接信息
+* 从本地到apple APNS服务器的Socket连接信息。
+* 每个连接有一个写消息的goroutine，消息经queue交给它依次发送。
+* Connection及Client在关闭或重连时会被清空，读写都要持有mutext。
  */
 type ConnectInfo struct {
-	Connection       *tls.Conn
-	App              string
-	Sandbox          bool
-	currentIndentity int32      // 通过该连接已发送的最大ID
-	number           int32      // 连接号数
-	lastActivity     int64      // 最后活跃时间
-	mutext           sync.Mutex // 同步锁
-	listeningQueue   bool       // 正在监听redis的队列吗
+	Connection   *tls.Conn
+	Client       *http.Client // HTTP/2通道使用的client
+	Endpoint     string       // HTTP/2通道的服务器地址
+	signer       *TokenSigner // 使用Token认证时的签名者，证书认证时为nil
+	Transport    string
+	App          string
+	Sandbox      bool
+	sequence     *identitySequence  // 连接号及通过该连接分配的消息ID
+	slot         int                // 在应用连接池中的位置
+	inflight     int32              // 排队及正在发送的消息数
+	queue        chan *Notification // 等待该连接发送的消息
+	streams      chan struct{}      // HTTP/2通道正在进行的请求
+	done         chan struct{}      // 连接关闭时close，写消息的goroutine随之退出
+	writers      sync.WaitGroup     // 写消息的goroutine及HTTP/2的请求
+	lastActivity int64              // 最后活跃时间，只由写消息的goroutine修改
+	mutext       sync.Mutex         // 同步锁
 }
 
-func (info *ConnectInfo) Reconnect() {
-	// renew the connection because of the long time idel.
-	if info.Connection == nil {
-		return
-	}
+func (info *ConnectInfo) IsConnected() bool {
 	info.mutext.Lock()
-	log.Println("get the connectionInfo lock")
-	if info.Connection == nil {
-		log.Println("already reconneting... quit!")
-		info.mutext.Unlock()
-		return
-	}
+	defer info.mutext.Unlock()
+	return info.isConnected()
+}
 
-	info.Connection.Close()
-	info.Connection = nil
+func (info *ConnectInfo) isConnected() bool {
+	if info.Transport == TRANSPORT_HTTP2 {
+		return info.Client != nil
+	}
+	return info.Connection != nil
+}
 
-	info.mutext.Unlock()
+func (info *ConnectInfo) Close() {
+	info.Disconnect()
+}
 
-	appname := info.App
-	folder := path.Join(appConfig.AppsDir, appname, PRODUCTION_FOLDER)
-	if info.Sandbox {
-		appname = strings.Replace(appname, DEVELOP_SUBFIX, "", 1)
-		folder = path.Join(appConfig.AppsDir, appname, DEVELOP_FOLDER)
+/**
+关闭连接，返回关闭前是否可用。同一个连接同时出错时只有一个调用者会得到true。
+*/
+func (info *ConnectInfo) Disconnect() bool {
+	info.mutext.Lock()
+	defer info.mutext.Unlock()
+	connected := info.isConnected()
+	if info.Connection != nil {
+		info.Connection.Close()
+		info.Connection = nil
+	}
+	if info.Client != nil {
+		info.Client.CloseIdleConnections()
+		info.Client = nil
+	}
+	if info.done != nil {
+		select {
+		case <-info.done:
+		default:
+			close(info.done)
+		}
 	}
+	return connected
+}
+
+/**
+当前的连接，已关闭时为nil。
+*/
+func (info *ConnectInfo) conn() (*tls.Conn, *http.Client) {
+	info.mutext.Lock()
+	defer info.mutext.Unlock()
+	return info.Connection, info.Client
+}
 
-	go connect(appname, path.Join(folder, KEY_FILE_NAME), path.Join(folder, CERT_FILE_NAME), info.Sandbox)
+func (info *ConnectInfo) Reconnect() {
+	// renew the connection because of the long time idel.
+	if !info.Disconnect() {
+		log.Println("already reconneting... quit!")
+		return
+	}
+	connectSlot(info.App, info.Sandbox, info.slot)
 }
 
+/**
+* 等待发送的消息：连接不可用时的消息及出错后需要重发的消息。
+* 连接恢复后由写消息的goroutine先发完这些消息，再发新的消息。
+ */
 type ErrorBucket struct {
 	ErrorMessages    *list.List
 	FallbackMessages *list.List
 	App              string
+	mutex            sync.Mutex
 }
 
 func ErrorBucketForApp(app string) *ErrorBucket {
+	errorBucketsMutex.Lock()
+	defer errorBucketsMutex.Unlock()
 	if errorBuckets[app] == nil {
 		bucket := NewErrorBucket(app)
 		errorBuckets[app] = bucket
@@ -294,49 +774,110 @@ func ErrorBucketForApp(app string) *ErrorBucket {
 }
 
 func NewErrorBucket(app string) *ErrorBucket {
-	return &ErrorBucket{list.New(), list.New(), app}
+	return &ErrorBucket{ErrorMessages: list.New(), FallbackMessages: list.New(), App: app}
 }
 
-func AddErrorMessage(notification *Notification) {
+func removeErrorBucket(app string) *ErrorBucket {
+	errorBucketsMutex.Lock()
+	defer errorBucketsMutex.Unlock()
+	bucket := errorBuckets[app]
+	delete(errorBuckets, app)
+	return bucket
+}
+
+func AddErrorMessage(notification *Notification) bool {
 	bucket := ErrorBucketForApp(notification.App)
-	bucket.AddErrorMessage(notification)
+	return bucket.AddErrorMessage(notification)
 }
 
-func AddFallbackMessage(notification *Notification) {
+func AddFallbackMessage(notification *Notification) bool {
 	bucket := ErrorBucketForApp(notification.App)
-	bucket.AddFallbackMessage(notification)
+	return bucket.AddFallbackMessage(notification)
 }
 
-func HasPendingMessage(info *ConnectInfo) bool {
-	bucket := ErrorBucketForApp(info.App)
-	return bucket.ErrorMessages.Len() != 0 || bucket.FallbackMessages.Len() != 0
+func HasPendingMessage(app string) bool {
+	return ErrorBucketForApp(app).Len() != 0
 }
 
-func (bucket *ErrorBucket) AddErrorMessage(notification *Notification) {
-	bucket.ErrorMessages.PushBack(notification)
+func (bucket *ErrorBucket) Len() int {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	return bucket.ErrorMessages.Len() + bucket.FallbackMessages.Len()
 }
 
-func (bucket *ErrorBucket) AddFallbackMessage(notification *Notification) {
-	bucket.FallbackMessages.PushBack(notification)
+/**
+等待的消息达到PendingBufferSize时不再接收新的消息。
+*/
+func (bucket *ErrorBucket) Full() bool {
+	return appConfig.PendingBufferSize > 0 && bucket.Len() >= int(appConfig.PendingBufferSize)
 }
 
-func (bucket *ErrorBucket) Next() *Notification {
-	var ele *list.Element
-	if bucket.ErrorMessages.Len() > 0 {
-		ele = bucket.ErrorMessages.Front()
-		if ele != nil {
-			bucket.ErrorMessages.Remove(ele)
-			return ele.Value.(*Notification)
+/**
+放入需要重发的消息，队列已满时丢弃并返回false。
+*/
+func (bucket *ErrorBucket) AddErrorMessage(notification *Notification) bool {
+	return bucket.add(bucket.ErrorMessages, notification)
+}
+
+func (bucket *ErrorBucket) AddFallbackMessage(notification *Notification) bool {
+	return bucket.add(bucket.FallbackMessages, notification)
+}
+
+func (bucket *ErrorBucket) add(messages *list.List, notification *Notification) bool {
+	bucket.mutex.Lock()
+	full := appConfig.PendingBufferSize > 0 &&
+		bucket.ErrorMessages.Len()+bucket.FallbackMessages.Len() >= int(appConfig.PendingBufferSize)
+	if !full {
+		messages.PushBack(notification)
+	}
+	bucket.mutex.Unlock()
+	if full {
+		log.Printf("too many pending messages for %s, drop message %s", bucket.App, notification.ApnsID)
+		RecordStatus(notification, STATUS_DROPPED, 0, "pending buffer is full")
+	}
+	return !full
+}
+
+/**
+把连接关闭时还没发出的消息按原来的顺序放回，排在其他新消息之前。这些消息已被接收，不受PendingBufferSize限制。
+*/
+func (bucket *ErrorBucket) Requeue(notifications []*Notification) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	for i := len(notifications) - 1; i >= 0; i-- {
+		bucket.FallbackMessages.PushFront(notifications[i])
+	}
+}
+
+func pendingBufferFull(app string) bool {
+	errorBucketsMutex.Lock()
+	bucket := errorBuckets[app]
+	errorBucketsMutex.Unlock()
+	return bucket != nil && bucket.Full()
+}
+
+/**
+取出所有等待发送的消息，重发的消息在前。
+*/
+func (bucket *ErrorBucket) TakeAll() []*Notification {
+	var messages []*Notification
+	for {
+		message := bucket.Next()
+		if message == nil {
+			return messages
 		}
+		messages = append(messages, message)
 	}
+}
 
-	if bucket.FallbackMessages.Len() > 0 {
-		ele = bucket.FallbackMessages.Front()
-		if ele != nil {
-			bucket.FallbackMessages.Remove(ele)
+func (bucket *ErrorBucket) Next() *Notification {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	for _, messages := range []*list.List{bucket.ErrorMessages, bucket.FallbackMessages} {
+		if ele := messages.Front(); ele != nil {
+			messages.Remove(ele)
 			return ele.Value.(*Notification)
 		}
 	}
-
 	return nil
 }
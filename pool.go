@@ -0,0 +1,345 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+* 每个应用（sandbox单独计算）可以有多个到苹果服务器的连接，消息分摊到各个连接上发送：
+* - round-robin：依次使用每个可用的连接
+* - least-inflight：使用正在发送的消息最少的连接
+* 每个连接有自己的连接号及消息ID，出错时只重建出错的那个连接，只重发该连接上的消息。
+ */
+
+const (
+	POOL_ROUND_ROBIN    = "round-robin"
+	POOL_LEAST_INFLIGHT = "least-inflight"
+)
+
+type ConnectionPool struct {
+	App            string
+	Sandbox        bool
+	Strategy       string
+	conns          []*ConnectInfo // 下标即连接的slot，重连中的slot为nil或未连接
+	next           int            // 下一个轮到的slot
+	mutex          sync.Mutex
+	listeningQueue bool // 正在监听redis的队列吗
+}
+
+/**
+应用的连接数及分配策略，app.json优先，其次为全局配置。app为bundle id。
+*/
+func poolOptions(app string) (int, string) {
+	options := loadAppOptions(app)
+	size, strategy := options.Connections, options.PoolStrategy
+	if size <= 0 {
+		size = appConfig.ConnectionsPerApp
+	}
+	if size <= 0 {
+		size = 1
+	}
+	if len(strategy) == 0 {
+		strategy = appConfig.PoolStrategy
+	}
+	return int(size), strategy
+}
+
+func newConnectionPool(app string, sandbox bool) *ConnectionPool {
+	pool := &ConnectionPool{App: app, Sandbox: sandbox}
+	pool.Configure()
+	return pool
+}
+
+func getPool(key string) *ConnectionPool {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+	return sockets[key]
+}
+
+/**
+取得应用的连接池，没有时新建一个。
+*/
+func ensurePool(key string, sandbox bool) *ConnectionPool {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+	if sockets[key] == nil {
+		sockets[key] = newConnectionPool(key, sandbox)
+	}
+	return sockets[key]
+}
+
+func removePool(key string) *ConnectionPool {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+	pool := sockets[key]
+	delete(sockets, key)
+	return pool
+}
+
+/**
+所有连接池的key，包括sandbox应用，已排序。
+*/
+func poolKeys() []string {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+	keys := make([]string, 0, len(sockets))
+	for key := range sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func allPools() []*ConnectionPool {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+	pools := make([]*ConnectionPool, 0, len(sockets))
+	for _, pool := range sockets {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+/**
+按最新的配置调整连接数，多出的连接稍后关闭。
+*/
+func (pool *ConnectionPool) Configure() int {
+	size, strategy := poolOptions(strings.Replace(pool.App, DEVELOP_SUBFIX, "", 1))
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.Strategy = strategy
+	for len(pool.conns) > size {
+		last := pool.conns[len(pool.conns)-1]
+		pool.conns = pool.conns[:len(pool.conns)-1]
+		if last != nil {
+			go closeReplacedConnection(last)
+		}
+	}
+	for len(pool.conns) < size {
+		pool.conns = append(pool.conns, nil)
+	}
+	if pool.next >= size {
+		pool.next = 0
+	}
+	return size
+}
+
+/**
+新连接放到它的slot上，返回被替换的仍然可用的旧连接。slot超出连接数时（连接数已调小）返回新连接本身。
+*/
+func (pool *ConnectionPool) Put(info *ConnectInfo) *ConnectInfo {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if info.slot >= len(pool.conns) {
+		return info
+	}
+	old := pool.conns[info.slot]
+	pool.conns[info.slot] = info
+	if old != nil && old.IsConnected() {
+		return old
+	}
+	return nil
+}
+
+/**
+round-robin下一次从该连接之后的连接开始。
+*/
+func (pool *ConnectionPool) advance(info *ConnectInfo) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.conns) != 0 {
+		pool.next = (info.slot + 1) % len(pool.conns)
+	}
+}
+
+/**
+可用的连接，按策略排好先后：round-robin从下一个轮到的连接开始，least-inflight按排队的消息数从少到多。
+*/
+func (pool *ConnectionPool) candidates() []*ConnectInfo {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var result []*ConnectInfo
+	size := len(pool.conns)
+	for i := 0; i < size; i++ {
+		info := pool.conns[(pool.next+i)%size]
+		if info != nil && info.IsConnected() {
+			result = append(result, info)
+		}
+	}
+	if pool.Strategy == POOL_LEAST_INFLIGHT {
+		sort.SliceStable(result, func(i, j int) bool {
+			return atomic.LoadInt32(&result[i].inflight) < atomic.LoadInt32(&result[j].inflight)
+		})
+	}
+	return result
+}
+
+/**
+把消息交给一个连接的发送队列，选中的连接队列已满时依次尝试其他连接。
+没有可用的连接时返回errNoConnection，所有连接的队列都满了时返回errQueueFull。
+*/
+func (pool *ConnectionPool) Dispatch(message *Notification) error {
+	candidates := pool.candidates()
+	if len(candidates) == 0 {
+		return errNoConnection
+	}
+	for _, info := range candidates {
+		if info.offer(message) {
+			pool.advance(info)
+			return nil
+		}
+	}
+	return errQueueFull
+}
+
+/**
+所有可用连接的发送队列都满了。
+*/
+func (pool *ConnectionPool) Saturated() bool {
+	candidates := pool.candidates()
+	for _, info := range candidates {
+		if len(info.queue) < cap(info.queue) {
+			return false
+		}
+	}
+	return len(candidates) != 0
+}
+
+/**
+标记正在监听Redis队列，已经在监听时返回false。
+*/
+func (pool *ConnectionPool) startWatching() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.listeningQueue {
+		return false
+	}
+	pool.listeningQueue = true
+	return true
+}
+
+/**
+查找分配了该序列的连接，即出错的那个连接。连接已被替换或移除时返回nil。
+*/
+func (pool *ConnectionPool) Find(sequence *identitySequence) *ConnectInfo {
+	if sequence == nil {
+		return nil
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, info := range pool.conns {
+		if info != nil && info.sequence == sequence {
+			return info
+		}
+	}
+	return nil
+}
+
+func (pool *ConnectionPool) SlotConnected(slot int) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return slot < len(pool.conns) && pool.conns[slot] != nil && pool.conns[slot].IsConnected()
+}
+
+/**
+任何一个连接可用即认为应用可用。
+*/
+func (pool *ConnectionPool) IsConnected() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, info := range pool.conns {
+		if info != nil && info.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *ConnectionPool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, info := range pool.conns {
+		if info != nil {
+			info.Close()
+		}
+	}
+}
+
+/**
+等待所有连接写消息的goroutine及正在进行的HTTP/2请求结束，需先Close。
+*/
+func (pool *ConnectionPool) Wait() {
+	pool.mutex.Lock()
+	conns := append([]*ConnectInfo(nil), pool.conns...)
+	pool.mutex.Unlock()
+	for _, info := range conns {
+		if info != nil {
+			info.writers.Wait()
+		}
+	}
+}
+
+/**
+排队及正在发送的消息数。
+*/
+func (pool *ConnectionPool) Inflight() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	count := 0
+	for _, info := range pool.conns {
+		if info != nil {
+			count += int(atomic.LoadInt32(&info.inflight))
+		}
+	}
+	return count
+}
+
+func appFolder(app string, sandbox bool) string {
+	if sandbox {
+		return path.Join(appConfig.AppsDir, app, DEVELOP_FOLDER)
+	}
+	return path.Join(appConfig.AppsDir, app, PRODUCTION_FOLDER)
+}
+
+/**
+建立应用的所有连接，app为bundle id。
+*/
+func connectPool(app string, sandbox bool) {
+	key := app
+	if sandbox {
+		key = app + DEVELOP_SUBFIX
+	}
+	// 连接池先建好，连不上时应用处于熔断状态而不是未知应用
+	size := ensurePool(key, sandbox).Configure()
+	log.Printf("create %d connections for %s", size, key)
+	for slot := 0; slot < size; slot++ {
+		connectSlot(key, sandbox, slot)
+	}
+}
+
+/**
+重建应用的某个连接，key为sockets的key。
+*/
+func connectSlot(key string, sandbox bool, slot int) {
+	if poolsClosed.Load() {
+		return
+	}
+	app := strings.Replace(key, DEVELOP_SUBFIX, "", 1)
+	folder := appFolder(app, sandbox)
+	go connect(app, path.Join(folder, KEY_FILE_NAME), path.Join(folder, CERT_FILE_NAME), sandbox, slot)
+}
+
+/**
+出错的响应来自哪个连接。
+*/
+func findConnection(err *APNSRespone) *ConnectInfo {
+	if pool := getPool(err.App); pool != nil {
+		return pool.Find(err.sequence)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* 应用的热加载。定时扫描AppsDir，与上次的结果比较：
+* - 新增的应用：建立连接
+* - 移除的应用：不再接受新消息，等待APP_DRAIN_TIME后关闭连接
+* - 证书、密钥或app.json有变化的应用：建立新连接，替换后再关闭旧连接，排队中的消息不受影响
+ */
+
+const APP_DRAIN_TIME = 10 * time.Second
+
+/**
+* AppsDir下的一个应用环境
+ */
+type appEntry struct {
+	App         string // bundle id
+	Sandbox     bool
+	Folder      string // develop或production目录
+	Fingerprint string // 证书、密钥及app.json的大小和修改时间
+	Transport   string // 使用的通道，校验消息时使用
+}
+
+func (entry *appEntry) Key() string {
+	if entry.Sandbox {
+		return entry.App + DEVELOP_SUBFIX
+	}
+	return entry.App
+}
+
+func (entry *appEntry) Connect() {
+	connectPool(entry.App, entry.Sandbox)
+}
+
+var knownApps map[string]*appEntry
+var knownAppsMutex sync.Mutex
+
+/**
+应用是否在AppsDir下，不管证书及连接的状态。key为连接池的key，sandbox应用带DEVELOP_SUBFIX。
+*/
+func isKnownApp(key string) bool {
+	knownAppsMutex.Lock()
+	_, known := knownApps[key]
+	knownAppsMutex.Unlock()
+	if known {
+		return true
+	}
+	// 还没扫描或在两次扫描之间新增的应用
+	app := strings.TrimSuffix(key, DEVELOP_SUBFIX)
+	info, err := os.Stat(appFolder(app, app != key))
+	return err == nil && info.IsDir()
+}
+
+/**
+扫描AppsDir下所有应用的develop及production目录。
+*/
+func scanApps() (map[string]*appEntry, error) {
+	apps := make(map[string]*appEntry)
+	walkErr := filepath.Walk(appConfig.AppsDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		defer CapturePanic(fmt.Sprintf("unkonw error when walk to appsDir %s, filePath %s, info.name %s", appConfig.AppsDir, filePath, info.Name()))
+		if !info.IsDir() {
+			return nil
+		}
+
+		if info.Name() != DEVELOP_FOLDER && info.Name() != PRODUCTION_FOLDER {
+			return nil
+		}
+
+		buff := bytes.NewBufferString(appConfig.AppsDir)
+		buff.WriteRune(os.PathSeparator)
+		app := strings.Replace(path.Dir(filePath), buff.String(), "", 1)
+		entry := &appEntry{App: app, Sandbox: info.Name() == DEVELOP_FOLDER, Folder: filePath}
+		entry.Fingerprint = fingerprint(filePath, path.Dir(filePath))
+		entry.Transport = resolveTransport(entry.Key())
+		apps[entry.Key()] = entry
+		return nil
+	})
+	return apps, walkErr
+}
+
+/**
+应用连接所依赖的文件的大小及修改时间，任何一个有变化都需要重新连接。
+*/
+func fingerprint(folder string, appDir string) string {
+	files := []string{
+		path.Join(folder, CERT_FILE_NAME),
+		path.Join(folder, KEY_FILE_NAME),
+		path.Join(appDir, APP_OPTIONS_FILE_NAME),
+	}
+	for _, dir := range []string{folder, appDir} {
+		matches, _ := filepath.Glob(path.Join(dir, AUTH_KEY_FILE_PREFIX+"*"+AUTH_KEY_FILE_SUFFIX))
+		files = append(files, matches...)
+	}
+	matches, _ := filepath.Glob(path.Join(folder, "*"+P12_FILE_SUFFIX))
+	files = append(files, matches...)
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&buf, "%s:%d:%d;", path.Base(file), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return buf.String()
+}
+
+func StartReloadService() {
+	defer CapturePanic("Reload service occur runtime error!")
+	if appConfig.AppReloadIntervalSecs <= 0 {
+		log.Println("app hot reload is disabled")
+		return
+	}
+	tick := time.NewTicker(time.Duration(appConfig.AppReloadIntervalSecs) * time.Second)
+
+	for {
+		select {
+		case _ = <-tick.C:
+			reloadApps()
+		}
+	}
+}
+
+func reloadApps() {
+	current, err := scanApps()
+	if err != nil {
+		log.Println("can not scan apps dir, skip reload", err)
+		return
+	}
+
+	knownAppsMutex.Lock()
+	defer knownAppsMutex.Unlock()
+	for key, entry := range current {
+		old, ok := knownApps[key]
+		if !ok {
+			log.Println("new app found, create socket for", key)
+			entry.Connect()
+		} else if old.Fingerprint != entry.Fingerprint {
+			log.Println("certificate or options changed, reconnect", key)
+			entry.Connect()
+		}
+	}
+	for key := range knownApps {
+		if _, ok := current[key]; !ok {
+			log.Println("app removed, close socket of", key)
+			go removeApp(key)
+		}
+	}
+	knownApps = current
+}
+
+/**
+移除应用：先从sockets中删除，新消息会被当成未知应用拒绝，
+等已发出的消息处理完后再关闭连接，等写消息的goroutine把没发出去的消息放回ErrorBucket并退出后，
+再把这些消息放回Redis队列（没有使用Redis队列时标记为丢弃）。
+*/
+func removeApp(app string) {
+	defer CapturePanic("fail to remove app " + app)
+	pool := removePool(app)
+	if pool == nil {
+		return
+	}
+	time.Sleep(APP_DRAIN_TIME)
+	pool.Close()
+	pool.Wait()
+
+	if bucket := removeErrorBucket(app); bucket != nil {
+		requeueToRedis(app, bucket.TakeAll(), "app removed")
+	}
+	log.Println("app removed:", app)
+}
+
+/**
+替换证书后，旧连接上已发出的消息可能还有错误返回，稍等再关闭。
+*/
+func closeReplacedConnection(old *ConnectInfo) {
+	defer CapturePanic("fail to close replaced connection")
+	time.Sleep(APP_DRAIN_TIME)
+	old.Close()
+}
@@ -6,31 +6,78 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/redis.v2"
 	"log"
-	"os"
 	"path"
-	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"time"
 )
 
-func connect(app string, keyFile string, certFile string, sandbox bool) {
+/**
+建立应用连接池中slot位置的连接，建好后扔给socketCN，连不上时稍后重试。
+*/
+func connect(app string, keyFile string, certFile string, sandbox bool, slot int) {
 	defer CapturePanic(fmt.Sprintf("connection to apns server error %s", app))
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	key := app
+	if sandbox {
+		key = app + DEVELOP_SUBFIX
+	}
+	info, err := dial(app, keyFile, certFile, sandbox)
+	if err != nil {
+		log.Printf("连接服务器有误 %s slot %d: %s", key, slot, err)
+		connectFailed(key, sandbox, slot, err)
+		return
+	}
+	// HTTP/2的client在发送时才建立连接，收到苹果的响应才算连接成功。
+	if info.Transport != TRANSPORT_HTTP2 {
+		connectSucceeded(key, slot)
+	}
+	info.slot = slot
+	socketCN <- info
+}
+
+func dial(app string, keyFile string, certFile string, sandbox bool) (*ConnectInfo, error) {
+	options := loadAppOptions(app)
+	signer, err := loadTokenSigner(app, path.Dir(keyFile), options)
+	if err != nil {
+		return nil, fmt.Errorf("loadAuthKey: %s", err)
+	}
+	if signer != nil {
+		// Token认证只能走HTTP/2通道，且无需客户端证书。
+		config, err := newTLSConfig(nil)
+		if err != nil {
+			return nil, fmt.Errorf("tlsConfig: %s", err)
+		}
+		info := connectHttp2(app, config, sandbox)
+		info.signer = signer
+		return info, nil
+	}
+
+	status := checkCertificate(app, sandbox, certFile, keyFile)
+	if !status.Healthy {
+		return nil, errors.New(status.Problem)
+	}
+	cert, err := loadCertificate(app, certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loadKeys: %s", err)
+	}
+	config, err := newTLSConfig([]tls.Certificate{cert})
 	if err != nil {
-		log.Printf("server : loadKeys: %s", err)
+		return nil, fmt.Errorf("tlsConfig: %s", err)
+	}
+	if options.Transport == TRANSPORT_HTTP2 {
+		return connectHttp2(app, config, sandbox), nil
 	}
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
 	endPoint := APNS_ENDPOINT
 	if sandbox {
 		endPoint = APNS_SANDBOX_ENDPOINT
 	}
-	conn, err := tls.Dial("tcp", endPoint, &config)
+	conn, err := tls.Dial("tcp", endPoint, config)
 	if err != nil {
-		log.Println("连接服务器有误", err)
-		return
+		return nil, describeTLSError(err)
 	}
 	log.Println("client is connect to ", conn.RemoteAddr())
 	state := conn.ConnectionState()
@@ -40,15 +87,14 @@ func connect(app string, keyFile string, certFile string, sandbox bool) {
 	if sandbox {
 		app = app + DEVELOP_SUBFIX
 	}
-	info := &ConnectInfo{Connection: conn, App: app, Sandbox: sandbox, lastActivity: time.Now().Unix()}
-	socketCN <- info
+	return &ConnectInfo{Connection: conn, App: app, Sandbox: sandbox, lastActivity: time.Now().Unix()}, nil
 }
 
 /**
 * 监听APNSSocket的返回结果，当有返回时，意味着发生错误了，这时把错误发到channel，同时关闭socket。
  */
-func monitorConn(conn *tls.Conn, app string, sandbox bool) {
-	defer CapturePanic(fmt.Sprint("panic when monitor Connection %s", app))
+func monitorConn(conn *tls.Conn, app string, sandbox bool, sequence *identitySequence) {
+	defer CapturePanic(fmt.Sprintf("panic when monitor Connection %s", app))
 	defer conn.Close()
 	reply := make([]byte, 6)
 	n, err := conn.Read(reply)
@@ -66,54 +112,55 @@ func monitorConn(conn *tls.Conn, app string, sandbox bool) {
 	var id int32
 	binary.Read(buf, binary.BigEndian, &id)
 
-	rsp := &APNSRespone{reply[0], reply[1], id, conn, app, sandbox}
+	rsp := &APNSRespone{Command: reply[0], Status: reply[1], Identifier: id,
+		Connection: conn, App: app, Sandbox: sandbox, Transport: TRANSPORT_BINARY, sequence: sequence}
 	responseCN <- rsp
 }
 
 func SocketConnected(info *ConnectInfo) {
 	defer CapturePanic("panic after socket connected")
 	app := info.App
-	if sockets[app] == nil {
-		sockets[app] = info
-	} else {
-		sockets[app].Connection = info.Connection
-		sockets[app].lastActivity = info.lastActivity
+	// 每个连接有自己的连接号及消息ID
+	info.sequence = newIdentitySequence()
+	info.startWriter()
+	pool := ensurePool(app, info.Sandbox)
+	// 证书更新后建立的新连接会替换仍然可用的旧连接，旧连接稍后关闭。
+	if old := pool.Put(info); old != nil {
+		go closeReplacedConnection(old)
+		if old == info {
+			// 连接数已调小，这个slot不再需要
+			return
+		}
 	}
-	go monitorConn(info.Connection, info.App, info.Sandbox)
-
-	// 有没有在监听redis队列？
-	if !sockets[app].listeningQueue && appConfig.QueueWithRedis {
-		go WatchMessageQueue(app)
+	if info.Transport != TRANSPORT_HTTP2 {
+		go monitorConn(info.Connection, info.App, info.Sandbox, info.sequence)
 	}
 
-	// 看看有没有消息需要重新发。
-	if HasPendingMessage(info) {
-		bucket := ErrorBucketForApp(info.App)
-		for {
-			notification := bucket.Next()
-			if notification == nil {
-				break
-			}
-			go Notify(notification)
-		}
+	// 有没有在监听redis队列？等待重发的消息由写消息的goroutine优先发送。
+	if appConfig.QueueWithRedis && pool.startWatching() {
+		go WatchMessageQueue(app)
 	}
 }
 
 func WatchMessageQueue(app string) {
 	defer CapturePanic("panic when watch message queue")
 
-	cli := redis.NewTCPClient(&redis.Options{
-		Addr:        fmt.Sprintf("%s:%d", appConfig.RedisHost, appConfig.RedisPort),
-		Password:    appConfig.RedisPassword,
-		DB:          appConfig.RedisDB,
-		PoolSize:    int(appConfig.RedisPoolsize),
-		DialTimeout: 10 * time.Second,
-	})
-	sockets[app].listeningQueue = true
+	cli := newRedisClient()
+	pool := getPool(app)
 	for {
+		// 应用已被移除或重新加入
+		if getPool(app) != pool {
+			log.Println("stop watching message queue of", app)
+			break
+		}
+		// 熔断、等待队列已满或发送队列都满了时，消息先留在Redis队列中
+		if !shutingDown.Load() && (len(appUnavailable(app)) != 0 || pool.Saturated()) {
+			time.Sleep(time.Second)
+			continue
+		}
 		msg := cli.BRPop(20, EXTERN_MESSAGE_QUEUE_PREFIX+app)
 
-		if shutingDown {
+		if shutingDown.Load() {
 			//把msg格式转换成Notification，然后入内部队列。
 			result, err := msg.Result()
 			if err != nil {
@@ -142,194 +189,197 @@ func WatchMessageQueue(app string) {
 			log.Println(err)
 			continue
 		}
-		payload, err := MakePayloadFromMap(dict["payload"].(map[string]interface{}))
+		notifications, shrinkResult, err := MakeNotificationsFromMap(dict, app)
 		if err != nil {
-			log.Println(err)
+			log.Println("invalid message from redis queue:", err)
 			continue
 		}
-		sandbox := dict["sandbox"].(bool)
-		token := dict["token"]
-		if tk, ok := token.([]interface{}); ok {
-			for t := range tk {
-				message := &Notification{tk[t].(string), &payload, app, sandbox}
-				go Notify(message)
+		if shrinkResult.Applied() {
+			log.Printf("payload shrinked %s", shrinkHeader(shrinkResult))
+		}
+		for _, message := range notifications {
+			RecordStatus(message, STATUS_ACCEPTED, 0, "")
+			if err := Notify(message); err != nil {
+				log.Printf("message %s from redis queue is not accepted: %s", message.ApnsID, err)
 			}
-		} else {
-			message := &Notification{token.(string), &payload, app, sandbox}
-			go Notify(message)
 		}
 	}
 
 }
 
 /**
-初始化socket连接，创建完后扔给channel
+把没发出去的消息按原来的顺序放回应用的Redis队列，WatchMessageQueue下次最先取到它们。
+没有使用Redis队列或放不回去时只能丢弃，reason为丢弃的原因。
 */
-func MakeSocket() (e error) {
-	// 创建几个socket？创建完后，由谁管理。
-	walkErr := filepath.Walk(appConfig.AppsDir, func(filePath string, info os.FileInfo, err error) error {
-		defer CapturePanic(fmt.Sprintf("unkonw error when walk to appsDir %s, filePath %s, info.name %s", appConfig.AppsDir, filePath, info.Name()))
-
-		if err != nil {
-			return nil
+func requeueToRedis(app string, messages []*Notification, reason string) {
+	if len(messages) == 0 {
+		return
+	}
+	if !appConfig.QueueWithRedis {
+		log.Printf("%d messages of %s are dropped: %s", len(messages), app, reason)
+		for _, message := range messages {
+			RecordStatus(message, STATUS_DROPPED, 0, reason)
 		}
-		if !info.IsDir() {
-			return nil
+		return
+	}
+	cli := newRedisClient()
+	defer cli.Close()
+	// BRPOP从右边取，倒着RPUSH后第一条消息在最右边
+	for i := len(messages) - 1; i >= 0; i-- {
+		data, err := queueMessageJson(messages[i])
+		if err == nil {
+			err = cli.RPush(EXTERN_MESSAGE_QUEUE_PREFIX+app, string(data)).Err()
 		}
-
-		if info.Name() != DEVELOP_FOLDER && info.Name() != PRODUCTION_FOLDER {
-			return nil
+		if err != nil {
+			log.Println("can not return message to redis queue", messages[i].ApnsID, err)
+			RecordStatus(messages[i], STATUS_DROPPED, 0, reason)
 		}
+	}
+	log.Printf("%d messages of %s are returned to redis queue", len(messages), app)
+}
 
-		buff := bytes.NewBufferString(appConfig.AppsDir)
-		buff.WriteRune(os.PathSeparator)
-		app := strings.Replace(path.Dir(filePath), buff.String(), "", 1)
-		log.Println("create socket for app :", app)
-		sandbox := false
-		if info.Name() == DEVELOP_FOLDER {
-			sandbox = true
+/**
+消息转换成Redis队列中的json格式，apns_id保持不变。
+*/
+func queueMessageJson(message *Notification) ([]byte, error) {
+	payload, err := message.Payload.Json()
+	if err != nil {
+		return nil, err
+	}
+	dict := map[string]interface{}{
+		"token":   message.Token,
+		"payload": json.RawMessage(payload),
+		"sandbox": message.Sandbox,
+		"apns_id": message.ApnsID,
+	}
+	if message.Expiry != 0 {
+		dict["expiry"] = message.Expiry
+	}
+	if message.Priority != 0 {
+		dict["priority"] = message.Priority
+	}
+	for key, value := range map[string]string{
+		"push_type":   message.PushType,
+		"collapse_id": message.CollapseID,
+		"topic":       message.Topic,
+	} {
+		if len(value) != 0 {
+			dict[key] = value
 		}
-		go connect(app,
-			path.Join(filePath, KEY_FILE_NAME),
-			path.Join(filePath, CERT_FILE_NAME),
-			sandbox)
-		return nil
-	})
+	}
+	return json.Marshal(dict)
+}
 
+/**
+初始化socket连接，创建完后扔给channel
+*/
+func MakeSocket() (e error) {
+	apps, walkErr := scanApps()
 	if walkErr != nil {
 		log.Print("读取证书有问题哇", walkErr)
 		return walkErr
-	} else {
-		return nil
 	}
-}
-
-func Notify(message *Notification) {
-	defer CapturePanic("notify fail")
-	// 先看该token是否在badtoken集合内
-	if isBadToken(message.App, message.Token) {
-		log.Println("token is a bad token ,skip push :", message.Token)
-		return
+	if unhealthy := checkCertificates(); unhealthy > 0 && appConfig.StrictCertificates {
+		return fmt.Errorf("%d certificates are expired or invalid", unhealthy)
 	}
-	// 根据app找到相应的socket。
-	info := sockets[message.App]
-	conn := info.Connection
-	if conn == nil {
-		// 扔进等待队列。
-		AddErrorMessage(message)
-		return
-	}
-
-	if time.Now().Unix()-info.lastActivity > appConfig.ConnectionIdleSecs {
-		log.Println("connection is idle for a long time, reconnect!")
-		go info.Reconnect()
-		AddFallbackMessage(message)
-		return
-	}
-
-	// 如果ErrorBucket内有东西，等待处理完毕，先扔回去。
-	if HasPendingMessage(info) {
-		log.Println("has peding message!")
-		AddFallbackMessage(message)
-		return
+	for key, entry := range apps {
+		log.Println("create socket for app :", key)
+		entry.Connect()
 	}
+	knownAppsMutex.Lock()
+	knownApps = apps
+	knownAppsMutex.Unlock()
+	return nil
+}
 
-	msgID := GetIdentity()
-	log.Println("store message into leveldb")
-	StoreMessage(message, msgID, info.number)
-	// 消息存入缓存，过期消失，如果失败会尝试重发。
-	log.Println("push!")
-	pushMessage(conn, message.Token, msgID, message.Payload)
+/**
+写socket出错，消息本身没有问题，可以换一个连接重发。
+*/
+type socketError struct {
+	err error
+}
 
-	info.currentIndentity = msgID
-	info.lastActivity = time.Now().Unix()
-	log.Println("finish push")
+func (e *socketError) Error() string {
+	return e.err.Error()
 }
 
-func pushMessage(conn *tls.Conn, token string, identity int32, payload *Payload) {
-	if len(token) == 0 {
+/**
+以command 2的格式写一条消息：
+command(1) | frame length(4) | item...
+每个item为 item id(1) | item length(2) | item data
+*/
+func pushMessage(conn *tls.Conn, identity int32, message *Notification) error {
+	if len(message.Token) == 0 {
 		log.Println("missing token")
-		return
+		return errors.New("missing token")
 	}
 
-	if payload == nil || payload.IsEmpty() {
+	if message.Payload == nil || message.Payload.IsEmpty() {
 		log.Println("not a valid payload")
-		return
-	}
-
-	buf := new(bytes.Buffer)
-
-	// command
-	var command byte = 1
-	err := binary.Write(buf, binary.BigEndian, command)
-	if err != nil {
-		log.Printf("fail to write command to buffer %s", err)
-	}
-
-	// identifier
-	err = binary.Write(buf, binary.BigEndian, identity)
-	if err != nil {
-		log.Printf("fail to write identity to buffer %s", err)
-	}
-
-	// expires
-	var expires int32 = int32(time.Now().AddDate(0, 0, 1).Unix())
-	err = binary.Write(buf, binary.BigEndian, expires)
-	if err != nil {
-		log.Printf("fail to write expires to buffer %s", err)
+		return errors.New("not a valid payload")
 	}
 
-	// token length
-	var tokenLength int16 = 32
-	err = binary.Write(buf, binary.BigEndian, tokenLength)
-	if err != nil {
-		log.Printf("fail to write tokensize to buffer %s", err)
+	if message.PushType == PUSH_TYPE_LIVEACTIVITY {
+		log.Println("live activity can only be sent through http2, skip")
+		return errors.New("live activity can only be sent through http2")
 	}
 
 	// token content
-	tokenBytes, err := hex.DecodeString(token)
-	if len(tokenBytes) != int(tokenLength) {
+	tokenBytes, err := hex.DecodeString(message.Token)
+	if err != nil || len(tokenBytes) != 32 {
 		log.Println("invalid token! ")
-		return
+		return errors.New("invalid token")
 	}
 
-	err = binary.Write(buf, binary.BigEndian, tokenBytes)
-	if err != nil {
-		log.Printf("fail to write token to buffer %s", err)
-	}
-
-	// payload length
-
-	payloadBytes, err := payload.Json()
+	payloadBytes, err := message.Payload.Json()
 	if err != nil {
 		log.Printf("json marshal error %s", err)
+		return err
 	}
-	if len(payloadBytes) > 256 {
-		// 压缩payload的长度。
 
-	}
+	frame := new(bytes.Buffer)
+	writeFrameItem(frame, FRAME_ITEM_TOKEN, tokenBytes)
+	writeFrameItem(frame, FRAME_ITEM_PAYLOAD, payloadBytes)
+	writeFrameItem(frame, FRAME_ITEM_IDENTIFIER, identity)
+	writeFrameItem(frame, FRAME_ITEM_EXPIRATION, int32(message.ExpiryTime()))
+	writeFrameItem(frame, FRAME_ITEM_PRIORITY, byte(message.PriorityValue()))
 
-	fmt.Printf("payload %s\n", string(payloadBytes))
-	var payloadLength int16 = int16(len(payloadBytes))
-	err = binary.Write(buf, binary.BigEndian, payloadLength)
+	buf := new(bytes.Buffer)
+
+	// command
+	var command byte = 2
+	err = binary.Write(buf, binary.BigEndian, command)
 	if err != nil {
-		log.Printf("fail to write payoadLength to buffer %s", err)
+		log.Printf("fail to write command to buffer %s", err)
 	}
 
-	// payload content
-	err = binary.Write(buf, binary.BigEndian, payloadBytes)
+	// frame length
+	err = binary.Write(buf, binary.BigEndian, int32(frame.Len()))
 	if err != nil {
-		log.Printf("fail to write payloadBytes to buffer %s", err)
+		log.Printf("fail to write frame length to buffer %s", err)
 	}
+	buf.Write(frame.Bytes())
 
 	// write to socket
 	size, err := conn.Write(buf.Bytes())
-	fmt.Printf("body: %x\n", buf.Bytes())
 	log.Printf("write body size %d", size)
 	if err != nil {
 		log.Printf("error when write to socket %s, %d", err, size)
+		return &socketError{err}
 	}
+	return nil
+}
 
+func writeFrameItem(frame *bytes.Buffer, itemID byte, data interface{}) {
+	item := new(bytes.Buffer)
+	err := binary.Write(item, binary.BigEndian, data)
+	if err != nil {
+		log.Printf("fail to write frame item %d to buffer %s", itemID, err)
+		return
+	}
+	frame.WriteByte(itemID)
+	binary.Write(frame, binary.BigEndian, int16(item.Len()))
+	frame.Write(item.Bytes())
 }
 
 /**
@@ -338,13 +388,18 @@ func pushMessage(conn *tls.Conn, token string, identity int32, payload *Payload)
 - 重发indentifier之后的消息。
 */
 func HandleError(err *APNSRespone) {
-	socketKey := err.App
-	dir := path.Join(appConfig.AppsDir, err.App)
-	defer func(string message) {
-		go connect(err.App,
-			path.Join(dir, KEY_FILE_NAME),
-			path.Join(dir, CERT_FILE_NAME),
-			err.Sandbox)
+	if err.Transport == TRANSPORT_HTTP2 {
+		defer CapturePanic("fail to handle http2 error")
+		handleHttp2Error(err)
+		return
+	}
+
+	// 找到出错的那个连接，错误来自已被替换的旧连接或已移除的应用时，无需重连。
+	info := findConnection(err)
+	defer func(message string) {
+		if info != nil {
+			connectSlot(err.App, err.Sandbox, info.slot)
+		}
 		if e := recover(); e != nil {
 			log.Println(message)
 			log.Printf("got runtime panic %v\n, stack %s\n", e, debug.Stack())
@@ -352,24 +407,32 @@ func HandleError(err *APNSRespone) {
 	}("fail to handle error")
 
 	// 干掉这条socket
-
-	if err.Sandbox {
-		dir = path.Join(strings.Replace(dir, DEVELOP_SUBFIX, "", 1), DEVELOP_FOLDER)
-	} else {
-		dir = path.Join(dir, PRODUCTION_FOLDER)
+	if info != nil {
+		info.Disconnect()
 	}
 
-	info := sockets[socketKey]
-	info.Connection = nil
-
-	if err.Command == 8 {
+	if err.Command == 8 && err.sequence != nil {
 		LogError(err.Status, err.Identifier)
-		messages := GetMessages(info, err.Identifier+1, info.currentIndentity)
+		connectNum := err.sequence.number
+		// Shutdown时identifier是最后一条发送成功的消息，没有消息被拒绝
+		if err.Status != APNS_ERROR_SHUTDOWN {
+			failed := GetMessage(err.App, connectNum, err.Identifier)
+			RecordStatus(failed, STATUS_REJECTED, int(err.Status), ErrorMessage(err.Status))
+			invalid := false
+			if err.Status == APNS_ERROR_INVALID_TOKEN && failed != nil {
+				invalid = markBadToken(failed.App, failed.Token, time.Now().Unix())
+			}
+			fireRejectedWebhook(failed, int(err.Status), ErrorMessage(err.Status), invalid)
+		}
+		messages := GetMessages(err.App, connectNum, err.sequence.After(err.Identifier))
 		for i := 0; i < len(messages); i++ {
 			msg := messages[i]
 			if msg != nil {
+				RecordStatus(msg, STATUS_REPLAYED, 0, "")
 				AddErrorMessage(messages[i])
 			}
 		}
+	} else {
+		FireWebhook(err.App, WEBHOOK_EVENT_CONNECTION_FAILURE, map[string]interface{}{"reason": "connection closed by apns"})
 	}
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleErrorReplaysAfterIdentifier(t *testing.T) {
+	for _, c := range []struct {
+		status   byte
+		rejected string // 被拒绝的消息的状态
+	}{
+		{APNS_ERROR_INVALID_TOKEN, STATUS_REJECTED},
+		{APNS_ERROR_SHUTDOWN, STATUS_SENT},
+	} {
+		appConfig = NewConfig()
+		store = NewMemoryStore()
+		sequence := newIdentitySequence()
+		messages := make([]*Notification, 3)
+		ids := make([]int32, 3)
+		for i := range messages {
+			messages[i] = &Notification{App: "com.a", Token: strings.Repeat("a", 64), ApnsID: NewUUID()}
+			ids[i] = sequence.Next()
+			StoreMessage(messages[i], ids[i], sequence.number)
+			RecordStatus(messages[i], STATUS_SENT, 0, "")
+		}
+
+		HandleError(&APNSRespone{Command: 8, Status: c.status, Identifier: ids[0], App: "com.a",
+			Transport: TRANSPORT_BINARY, sequence: sequence})
+
+		if status := getMessageStatus(messages[0].ApnsID); status.Status != c.rejected {
+			t.Errorf("status %d: identified message is %s, want %s", c.status, status.Status, c.rejected)
+		}
+		if bad := isBadToken("com.a", messages[0].Token); bad != (c.status == APNS_ERROR_INVALID_TOKEN) {
+			t.Errorf("status %d: token is marked bad: %t", c.status, bad)
+		}
+		bucket := ErrorBucketForApp("com.a")
+		for _, message := range messages[1:] {
+			if next := bucket.Next(); next == nil || next.ApnsID != message.ApnsID {
+				t.Errorf("status %d: replayed %+v, want %s", c.status, next, message.ApnsID)
+			}
+		}
+		if next := bucket.Next(); next != nil {
+			t.Errorf("status %d: %s is replayed", c.status, next.ApnsID)
+		}
+		removeErrorBucket("com.a")
+		closeStore()
+	}
+}
+
+func TestPushMessageFrame(t *testing.T) {
+	appConfig = NewConfig()
+	clientConn, serverConn := net.Pipe()
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	token := strings.Repeat("0a", 32)
+	message := &Notification{App: "com.a", Token: token, Expiry: 1700000000, Priority: APNS_PRIORITY_POWER_SAVING,
+		Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}
+	sent := make(chan error, 1)
+	go func() { sent <- pushMessage(client, 7, message) }()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 2 {
+		t.Fatalf("command is %d", header[0])
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(server, frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	items := make(map[byte][]byte)
+	for reader := bytes.NewReader(frame); reader.Len() != 0; {
+		var id byte
+		var length uint16
+		binary.Read(reader, binary.BigEndian, &id)
+		binary.Read(reader, binary.BigEndian, &length)
+		items[id] = make([]byte, length)
+		if _, err := io.ReadFull(reader, items[id]); err != nil {
+			t.Fatalf("item %d: %s", id, err)
+		}
+	}
+	payload, _ := message.Payload.Json()
+	for id, want := range map[byte][]byte{
+		FRAME_ITEM_TOKEN:      mustDecodeHex(t, token),
+		FRAME_ITEM_PAYLOAD:    payload,
+		FRAME_ITEM_IDENTIFIER: {0, 0, 0, 7},
+		FRAME_ITEM_EXPIRATION: {0x65, 0x53, 0xf1, 0x00},
+		FRAME_ITEM_PRIORITY:   {APNS_PRIORITY_POWER_SAVING},
+	} {
+		if !bytes.Equal(items[id], want) {
+			t.Errorf("item %d is %x, want %x", id, items[id], want)
+		}
+	}
+	if len(items) != 5 {
+		t.Errorf("frame has %d items", len(items))
+	}
+
+	// 不合法的消息不会写入连接
+	for _, invalid := range []*Notification{
+		{App: "com.a", Token: "abcd", Payload: message.Payload},
+		{App: "com.a", Token: token, Payload: message.Payload, PushType: PUSH_TYPE_LIVEACTIVITY},
+		{App: "com.a", Token: token, Payload: &Payload{Aps: &AlertInfo{}}},
+	} {
+		if err := pushMessage(nil, 8, invalid); err == nil {
+			t.Errorf("%+v is sent", invalid)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+/**
+自签名的服务器证书，用于本地的TLS连接。
+*/
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goapns test"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestPushMessageRejectsUnencodablePayload(t *testing.T) {
+	// 编码失败的payload不会写入连接，conn为nil时写入会panic
+	message := &Notification{App: "com.a", Token: strings.Repeat("0a", 32),
+		Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}, Custom: map[string]interface{}{"f": func() {}}}}
+	if err := pushMessage(nil, 1, message); err == nil {
+		t.Fatal("unencodable payload is sent")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**
+* payload超过大小限制时的压缩策略。按Trim中的顺序依次裁剪字段，直到payload满足限制：
+* - alert.body、alert.title、alert.subtitle：截断文字并加上省略号
+* - alert.loc-args：从最长的参数开始截断
+* - custom.<key>：截断自定义字段的文字，不是文字的字段直接删除
+* Reject为true时不做任何裁剪，超出限制直接拒绝。
+ */
+
+type ShrinkOptions struct {
+	Limit    int            `json:",omitempty"` // 大小限制，0为该推送类型及通道允许的最大值
+	Limits   map[string]int `json:",omitempty"` // 按"<通道>/<推送类型>"或"<通道>"指定的大小限制，优先于Limit
+	Ellipsis string         `json:",omitempty"` // 截断后追加的后缀
+	Trim     []string       `json:",omitempty"` // 可裁剪的字段，按优先级排列
+	Reject   bool           `json:",omitempty"` // 超出限制时直接拒绝
+}
+
+/**
+* 压缩的结果，会返回给调用方
+ */
+type ShrinkResult struct {
+	OriginalSize int      `json:"original_size"`
+	Size         int      `json:"size"`
+	Limit        int      `json:"limit"`
+	Trimmed      []string `json:"trimmed,omitempty"` // 实际裁剪过的字段
+}
+
+func (result *ShrinkResult) Applied() bool {
+	return result != nil && len(result.Trimmed) != 0
+}
+
+func NewShrinkOptions() ShrinkOptions {
+	return ShrinkOptions{Ellipsis: "…", Trim: []string{SHRINK_ALERT_BODY}}
+}
+
+/**
+压缩的大小限制：依次查找Limits中的"<transport>/<pushType>"及"<transport>"，都没有时使用Limit，
+不超过该推送类型及通道允许的最大值。未指定推送类型时按alert查找。
+*/
+func (options ShrinkOptions) limit(transport string, pushType string) int {
+	max := payloadSizeLimit(transport, pushType)
+	if len(pushType) == 0 {
+		pushType = PUSH_TYPE_ALERT
+	}
+	limit := options.Limit
+	if value, ok := options.Limits[transport+"/"+pushType]; ok {
+		limit = value
+	} else if value, ok := options.Limits[transport]; ok {
+		limit = value
+	}
+	if limit > 0 && limit < max {
+		return limit
+	}
+	return max
+}
+
+/**
+压缩payload使其不超过pushType及通道transport的大小限制，payload会被直接修改。
+无法压缩到限制以内或要求拒绝时返回ValidationErrors。
+*/
+func (payload *Payload) Shrink(pushType string, transport string, options ShrinkOptions) (*ShrinkResult, error) {
+	limit := options.limit(transport, pushType)
+	data, err := payload.rawJson()
+	if err != nil {
+		return nil, err
+	}
+	result := &ShrinkResult{OriginalSize: len(data), Size: len(data), Limit: limit}
+	if result.Size <= limit {
+		return result, nil
+	}
+
+	if !options.Reject {
+		for _, field := range options.Trim {
+			for result.Size > limit {
+				if !payload.trimField(field, result.Size-limit, options.Ellipsis) {
+					break
+				}
+				if len(result.Trimmed) == 0 || result.Trimmed[len(result.Trimmed)-1] != field {
+					result.Trimmed = append(result.Trimmed, field)
+				}
+				data, err = payload.rawJson()
+				if err != nil {
+					return result, err
+				}
+				result.Size = len(data)
+			}
+		}
+	}
+
+	if result.Size > limit {
+		var errs ValidationErrors
+		errs.add("", RULE_SIZE, limit, "payload is %d bytes, exceeds %d bytes", result.Size, limit)
+		return result, errs
+	}
+	return result, nil
+}
+
+/**
+把字段缩短over个字节，字段不存在或已无法再缩短时返回false。
+*/
+func (payload *Payload) trimField(field string, over int, ellipsis string) bool {
+	if strings.HasPrefix(field, SHRINK_CUSTOM_PREFIX) {
+		key := strings.TrimPrefix(field, SHRINK_CUSTOM_PREFIX)
+		value, ok := payload.Custom[key]
+		if !ok {
+			return false
+		}
+		if str, ok := value.(string); ok && len(str) != 0 {
+			payload.Custom[key] = truncateWithEllipsis(str, over, ellipsis)
+		} else {
+			delete(payload.Custom, key)
+		}
+		return true
+	}
+
+	if payload.Aps == nil {
+		return false
+	}
+	if str, ok := payload.Aps.Alert.(string); ok {
+		if field != SHRINK_ALERT_BODY || len(str) == 0 {
+			return false
+		}
+		payload.Aps.Alert = truncateWithEllipsis(str, over, ellipsis)
+		return true
+	}
+	alert, ok := payload.Aps.Alert.(AlertObject)
+	if !ok {
+		return false
+	}
+
+	var text *string
+	switch field {
+	case SHRINK_ALERT_BODY:
+		text = &alert.Body
+	case SHRINK_ALERT_TITLE:
+		text = &alert.Title
+	case SHRINK_ALERT_SUBTITLE:
+		text = &alert.Subtitle
+	case SHRINK_ALERT_LOC_ARGS:
+		// 每次截断最长的那个参数
+		longest := -1
+		for i, arg := range alert.LocalizedArguments {
+			if len(arg) != 0 && (longest < 0 || len(arg) > len(alert.LocalizedArguments[longest])) {
+				longest = i
+			}
+		}
+		if longest < 0 {
+			return false
+		}
+		text = &alert.LocalizedArguments[longest]
+	default:
+		return false
+	}
+	if len(*text) == 0 {
+		return false
+	}
+	*text = truncateWithEllipsis(*text, over, ellipsis)
+	payload.Aps.Alert = alert
+	return true
+}
+
+/**
+把s缩短over个字节并加上省略号，剩下的内容放不下省略号时返回空字符串。
+*/
+func truncateWithEllipsis(s string, over int, ellipsis string) string {
+	length := len(s) - over - len(ellipsis)
+	if length <= 0 {
+		return ""
+	}
+	return TruncateString(s, length) + ellipsis
+}
+
+/**
+取得应用的压缩策略，app.json中没有配置时使用全局配置。
+*/
+func shrinkOptionsForApp(app string) ShrinkOptions {
+	options := loadAppOptions(strings.Replace(app, DEVELOP_SUBFIX, "", 1))
+	if options.Shrink != nil {
+		return *options.Shrink
+	}
+	return appConfig.Shrink
+}
+
+/**
+按应用的策略压缩消息的payload。
+*/
+func (notification *Notification) Shrink() (*ShrinkResult, error) {
+	if notification.Payload == nil {
+		return nil, nil
+	}
+	result, err := notification.Payload.Shrink(notification.PushType, appTransport(notification.App), shrinkOptionsForApp(notification.App))
+	if err != nil {
+		var errs ValidationErrors
+		errs.merge(err, "payload")
+		return result, errs
+	}
+	return result, nil
+}
+
+/**
+在响应头中告诉调用方哪些字段被裁剪了。
+*/
+func shrinkHeader(result *ShrinkResult) string {
+	return fmt.Sprintf("%d>%d %s", result.OriginalSize, result.Size, strings.Join(result.Trimmed, ","))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShrink(t *testing.T) {
+	payload, err := MakePayloadFromString(`{"aps": {"alert": {"body": "` + strings.Repeat("é", 1500) +
+		`", "loc-args": ["` + strings.Repeat("a", 2000) + `", "b"]}}, "desc": "` + strings.Repeat("d", 2000) + `", "obj": {"a": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := payload.Shrink("", TRANSPORT_HTTP2, ShrinkOptions{Ellipsis: "…", Trim: []string{"custom.obj", "custom.desc", "alert.loc-args", "alert.body"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := payload.Json()
+	if len(data) > PAYLOAD_MAX_SIZE || result.Size != len(data) || result.Limit != PAYLOAD_MAX_SIZE {
+		t.Fatalf("payload is %d bytes, result %+v", len(data), result)
+	}
+	// 按顺序裁剪，满足限制后不再裁剪后面的字段
+	if !reflect.DeepEqual(result.Trimmed, []string{"custom.obj", "custom.desc", "alert.loc-args"}) {
+		t.Fatalf("trimmed %v", result.Trimmed)
+	}
+	alert := payload.Aps.Alert.(AlertObject)
+	if _, ok := payload.Custom["obj"]; ok || !strings.HasSuffix(alert.LocalizedArguments[0], "…") ||
+		alert.LocalizedArguments[1] != "b" || len(alert.Body) != 3000 {
+		t.Fatalf("shrunk payload is %s", data)
+	}
+
+	// 截断时不会切开多字节字符
+	payload, _ = MakePayloadFromString(`{"aps": {"alert": "` + strings.Repeat("é", 3000) + `"}}`)
+	if _, err := payload.Shrink("", TRANSPORT_HTTP2, ShrinkOptions{Reject: true}); err == nil {
+		t.Fatal("oversized payload is not rejected")
+	}
+	result, err = payload.Shrink("", TRANSPORT_HTTP2, NewShrinkOptions())
+	data, _ = payload.Json()
+	if err != nil || !result.Applied() || len(data) > PAYLOAD_MAX_SIZE || !strings.HasSuffix(payload.Aps.Alert.(string), "é…") {
+		t.Fatalf("result %+v %v, payload is %d bytes", result, err, len(data))
+	}
+
+	// 按通道及推送类型指定的限制
+	options := ShrinkOptions{Limit: 3000, Limits: map[string]int{"http2/voip": 1000, "binary": 1500}}
+	for _, c := range []struct {
+		transport string
+		pushType  string
+		limit     int
+	}{
+		{TRANSPORT_HTTP2, PUSH_TYPE_VOIP, 1000},
+		{TRANSPORT_HTTP2, "", 3000},
+		{TRANSPORT_BINARY, PUSH_TYPE_ALERT, 1500},
+	} {
+		if limit := options.limit(c.transport, c.pushType); limit != c.limit {
+			t.Errorf("%s/%s: limit is %d, want %d", c.transport, c.pushType, limit, c.limit)
+		}
+	}
+	if limit := (ShrinkOptions{Limit: 3000}).limit(TRANSPORT_BINARY, ""); limit != BINARY_PAYLOAD_MAX_SIZE {
+		t.Errorf("limit is %d, exceeds what binary transport allows", limit)
+	}
+
+	// 无法裁剪到限制以内
+	payload, _ = MakePayloadFromString(`{"aps": {"alert": {"title": "` + strings.Repeat("t", 5000) + `"}}}`)
+	if _, err := payload.Shrink("", TRANSPORT_HTTP2, NewShrinkOptions()); err == nil {
+		t.Fatal("payload is not rejected after trimming")
+	}
+}
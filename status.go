@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* 每条消息的投递记录，以消息ID（apns-id）为key存到数据库：
+* - MS:<id> 消息的所有状态变化
+* - MT:<app>_<token>_<time>_<id> 按token查询的索引
+ */
+
+const (
+	STATUS_ACCEPTED = "accepted" // 已接收，等待推送
+	STATUS_SENT     = "sent"     // 已发给苹果
+	STATUS_REJECTED = "rejected" // 被苹果拒绝
+	STATUS_REPLAYED = "replayed" // 因连接出错重新排队
+	STATUS_DROPPED  = "dropped"  // token已失效或无法发送，不再推送
+	STATUS_EXPIRED  = "expired"  // 推送前已过期
+
+	MESSAGE_STATUS_PREFIX = "MS:"
+	TOKEN_MESSAGE_PREFIX  = "MT:"
+
+	DEFAULT_MESSAGE_QUERY_LIMIT = 50
+)
+
+var statusMutex sync.Mutex
+
+type StatusEvent struct {
+	Status     string `json:"status"`
+	Time       int64  `json:"time"`                  // unix时间戳，毫秒
+	ApnsStatus int    `json:"apns_status,omitempty"` // HTTP/2的状态码或二进制协议的错误码
+	Reason     string `json:"reason,omitempty"`
+}
+
+type MessageStatus struct {
+	ID     string         `json:"id"`
+	App    string         `json:"app"`
+	Token  string         `json:"token"`
+	Status string         `json:"status"` // 最新的状态
+	Events []*StatusEvent `json:"events"`
+}
+
+func getMessageStatus(id string) *MessageStatus {
+	data := getRecord(MESSAGE_STATUS_PREFIX + id)
+	if len(data) == 0 {
+		return nil
+	}
+	var status MessageStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		log.Println("can not decode message status", id, err)
+		return nil
+	}
+	return &status
+}
+
+/**
+记录消息的一次状态变化。没有消息ID的消息（如升级前存档的消息）不记录。
+*/
+func RecordStatus(notification *Notification, status string, apnsStatus int, reason string) {
+	if notification == nil || len(notification.ApnsID) == 0 {
+		return
+	}
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	now := time.Now()
+	record := getMessageStatus(notification.ApnsID)
+	if record == nil {
+		record = &MessageStatus{ID: notification.ApnsID, App: notification.App, Token: notification.Token}
+		putRecord(fmt.Sprintf("%s%s_%s_%020d_%s", TOKEN_MESSAGE_PREFIX, notification.App,
+			notification.Token, now.UnixNano(), notification.ApnsID), []byte(notification.ApnsID))
+	}
+	record.Status = status
+	record.Events = append(record.Events, &StatusEvent{status, now.UnixNano() / int64(time.Millisecond), apnsStatus, reason})
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Println("can not encode message status", err)
+		return
+	}
+	putRecord(MESSAGE_STATUS_PREFIX+notification.ApnsID, data)
+}
+
+/**
+清理一个应用的投递记录，保留时长及条数与消息存档相同。返回删除的条数。
+*/
+func compactStatus(app string, now time.Time) int {
+	type index struct {
+		key  string
+		id   string
+		time int64 // 秒
+	}
+	cutoff, protected := archiveCutoff(now)
+	prefix := fmt.Sprintf("%s%s_", TOKEN_MESSAGE_PREFIX, app)
+	var indexes []*index
+	scanRecords(prefix, func(key string, value []byte) bool {
+		// <token>_<time>_<id>，sandbox应用的key（app_dev_...）会多出一段，跳过
+		parts := strings.Split(strings.TrimPrefix(key, prefix), "_")
+		if len(parts) != 3 {
+			return true
+		}
+		nano, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return true
+		}
+		indexes = append(indexes, &index{key, string(value), nano / int64(time.Second)})
+		return true
+	})
+	sort.SliceStable(indexes, func(i, j int) bool { return indexes[i].time < indexes[j].time })
+
+	over := archiveOverflow(len(indexes))
+	removed := 0
+	for i, index := range indexes {
+		if index.time < protected && (index.time < cutoff || i < over) {
+			statusMutex.Lock()
+			deleteRecord(index.key)
+			deleteRecord(MESSAGE_STATUS_PREFIX + index.id)
+			statusMutex.Unlock()
+			removed++
+		}
+	}
+	return removed
+}
+
+/**
+查询发给某个token的消息，按时间从新到旧返回最多limit条。
+*/
+func getTokenMessages(app string, token string, limit int) []*MessageStatus {
+	var ids []string
+	scanRecords(fmt.Sprintf("%s%s_%s_", TOKEN_MESSAGE_PREFIX, app, token), func(key string, value []byte) bool {
+		ids = append(ids, string(value))
+		return true
+	})
+	result := make([]*MessageStatus, 0, limit)
+	for i := len(ids) - 1; i >= 0 && len(result) < limit; i-- {
+		if status := getMessageStatus(ids[i]); status != nil {
+			result = append(result, status)
+		}
+	}
+	return result
+}
+
+/**
+GET /v2/messages/<id>：查询一条消息的投递记录
+GET /v2/messages?app=&token=&sandbox=&limit=：查询发给某个token的消息
+*/
+func messagesHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(request.URL.Path, "/v2/messages"), "/")
+	if len(id) != 0 {
+		status := getMessageStatus(id)
+		if status == nil {
+			writeApiError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeJson(w, http.StatusOK, status)
+		return
+	}
+
+	app := request.FormValue("app")
+	token := normalizeToken(request.FormValue("token"))
+	if len(app) == 0 || len(token) == 0 {
+		writeValidationErrors(w, ValidationErrors{{"app", RULE_REQUIRED, 0, "app and token are required"}})
+		return
+	}
+	if sb := request.FormValue("sandbox"); sb == "1" || sb == "true" {
+		app = app + DEVELOP_SUBFIX
+	}
+	limit, err := strconv.Atoi(request.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = DEFAULT_MESSAGE_QUERY_LIMIT
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"messages": getTokenMessages(app, token, limit)})
+}
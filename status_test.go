@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactStatus(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.ArchiveMaxPerApp = 2
+	store = NewMemoryStore()
+	defer closeStore()
+
+	token := strings.Repeat("a", 64)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		message := &Notification{App: "com.a", Token: token, ApnsID: NewUUID()}
+		RecordStatus(message, STATUS_ACCEPTED, 0, "")
+		RecordStatus(message, STATUS_SENT, 0, "")
+		ids = append(ids, message.ApnsID)
+		time.Sleep(time.Millisecond)
+	}
+	sandbox := &Notification{App: "com.a_dev", Token: token, ApnsID: NewUUID()}
+	RecordStatus(sandbox, STATUS_ACCEPTED, 0, "")
+
+	if removed := compactStatus("com.a", time.Now()); removed != 0 {
+		t.Fatalf("removed %d recent records", removed)
+	}
+	later := time.Now().Add((ARCHIVE_MIN_AGE_SECS + 1) * time.Second)
+	if removed := compactStatus("com.a", later); removed != 1 || getMessageStatus(ids[0]) != nil {
+		t.Fatalf("removed %d records over the per app limit", removed)
+	}
+	if messages := getTokenMessages("com.a", token, 10); len(messages) != 2 || messages[0].ID != ids[2] {
+		t.Fatalf("remaining messages %+v", messages)
+	}
+	if removed := compactStatus("com.a", time.Now().Add(25*time.Hour)); removed != 2 {
+		t.Fatalf("removed %d expired records", removed)
+	}
+	if getMessageStatus(sandbox.ApnsID) == nil {
+		t.Fatal("status of sandbox app is removed with com.a")
+	}
+}
@@ -3,135 +3,355 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
-	"github.com/jmhodges/levigo"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var db *levigo.DB
+/**
+* 存储层。消息存档、消息ID、bad token以及投递状态等附属数据都通过Store读写，
+* 具体使用哪个后端由AppConfig.StoreBackend决定：
+* - leveldb：默认，需要cgo及levigo
+* - bolt：纯Go的嵌入式数据库，无需cgo
+* - memory：只存在内存中，进程退出后丢失，用于测试
+* - redis：存到AppConfig中配置的Redis，供多个实例共享
+ */
 
-func getDB() *levigo.DB {
-	if db == nil {
-		opts := levigo.NewOptions()
-		opts.SetCache(levigo.NewLRUCache(3 << 30))
-		opts.SetCreateIfMissing(true)
-		_db, err := levigo.Open(appConfig.DbPath, opts)
+const (
+	STORE_LEVELDB = "leveldb"
+	STORE_BOLT    = "bolt"
+	STORE_MEMORY  = "memory"
+	STORE_REDIS   = "redis"
+
+	LATEST_IDENTITY_KEY = "latest_indentity"
+	CONNECTION_NUM_KEY  = "connection_number"
+	BAD_TOKEN_PREFIX    = "BT:"
+)
+
+type Store interface {
+	StoreMessage(notification *Notification, msgID int32, connectNum int32)
+	GetMessage(app string, connectNum int32, msgID int32) *Notification
+	ScanMessages(app string, fn func(message *ArchivedMessage) bool)
+	DeleteMessage(app string, connectNum int32, msgID int32)
+	MessageApps() []string // 存档中出现过的所有应用，包括已移除的应用
+
+	Incr(key string, delta int32) int32 // 计数器加上delta并返回新值，超出int32时从头开始
+
+	BadTokenTime(app string, token string) int64           // token失效的时间，不是bad token时返回0
+	AddBadToken(app string, token string, invalidAt int64) // invalidAt为token失效的unix时间戳
+	RecoverToken(app string, token string)
+
+	// 通用的记录读写，用于投递状态、回调队列等附属数据
+	Put(key string, value []byte)
+	Get(key string) []byte
+	Delete(key string)
+	Scan(prefix string, fn func(key string, value []byte) bool) // 按key的顺序遍历，fn返回false时停止
+
+	// 占用key一段时间，已被占用时返回false。多个实例共用Redis时用来保证一个任务只由一个实例处理
+	Claim(key string, ttl time.Duration) bool
+
+	Close()
+}
+
+/**
+* 键值数据库后端，kvStore在其上实现Store。
+ */
+type kvBackend interface {
+	Put(key string, value []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Scan(prefix string, fn func(key string, value []byte) bool) error
+	Close() error
+}
+
+var storeBackends = map[string]func(config *AppConfig) (Store, error){}
+
+var store Store
+var storeMutex sync.Mutex
+var storeClosed bool // 关闭服务器时已关闭，不再重新打开
+
+func getStore() Store {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store == nil && storeClosed {
+		log.Panicln("store is used after it is closed")
+	}
+
+	if store == nil {
+		backend := appConfig.StoreBackend
+		if len(backend) == 0 {
+			backend = STORE_LEVELDB
+		}
+		open, ok := storeBackends[backend]
+		if !ok {
+			log.Fatalf("unknown store backend %s, available: %s", backend, availableStores())
+		}
+		_store, err := open(&appConfig)
 		if err != nil {
 			log.Fatalln("can not open database, ", err)
 		}
-		db = _db
+		store = _store
 	}
-	return db
+	return store
 }
 
-func StoreMessage(notification *Notification, msgID int32, connectNum int32) {
-	// 序列化该消息到数据库。消息的key为：app_msgID.
-	wo := levigo.NewWriteOptions()
-	defer wo.Close()
-	key := fmt.Sprintf("%s_%d_%d", notification.App, connectNum, msgID)
-	log.Println("store message to database ", key)
-	var body bytes.Buffer
-	enc := gob.NewEncoder(&body)
-	enc.Encode(notification)
-	err := getDB().Put(wo, []byte(key), body.Bytes())
-	if err != nil {
-		log.Println("can not store message to database")
+func availableStores() string {
+	var names []string
+	for name := range storeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func closeStore() {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store != nil {
+		store.Close()
+		store = nil
+		storeClosed = true
 	}
 }
 
-func GetMessage(ro *levigo.ReadOptions, info *ConnectInfo, identifier int32) *Notification {
+type kvStore struct {
+	backend      kvBackend
+	counterMutex sync.Mutex
+	claims       map[string]time.Time // 本地数据库只有一个实例，占用记录放在内存中即可
+	claimMutex   sync.Mutex
+}
 
-	key := fmt.Sprintf("%s_%d_%d", info.App, info.number, identifier)
-	data, err := getDB().Get(ro, []byte(key))
-	if err != nil {
-		log.Println("can not get data from leveldb", err)
+func messageKey(app string, connectNum int32, msgID int32) string {
+	return fmt.Sprintf("%s_%d_%d", app, connectNum, msgID)
+}
+
+func (s *kvStore) StoreMessage(notification *Notification, msgID int32, connectNum int32) {
+	// 序列化该消息到数据库。消息的key为：app_connectNum_msgID.
+	key := messageKey(notification.App, connectNum, msgID)
+	log.Println("store message to database ", key)
+	body := encodeArchive(notification)
+	if body == nil {
+		return
 	}
-	body := bytes.NewBuffer(data)
-	var notification Notification
-	dec := gob.NewDecoder(body)
-	err = dec.Decode(&notification)
-	if err != nil {
-		log.Println("can not decode notification from archive", err)
-		return nil
+	if err := s.backend.Put(key, body); err != nil {
+		log.Println("can not store message to database", err)
 	}
-	return &notification
 }
 
-func GetMessages(info *ConnectInfo, fromID int32, toID int32) []*Notification {
-	log.Printf("get message from %d to %d", fromID, toID)
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-	result := make([]*Notification, toID-fromID+1, toID-fromID+1)
-	log.Println("message result length ", len(result))
-	for i := fromID; i < toID+1; i++ {
-		log.Println("get message with id", i)
-		notification := GetMessage(ro, info, i)
-		if notification != nil {
-			result[i-fromID] = notification
-		}
+func (s *kvStore) GetMessage(app string, connectNum int32, msgID int32) *Notification {
+	data, err := s.backend.Get(messageKey(app, connectNum, msgID))
+	if err != nil {
+		log.Println("can not get message from database", err)
 	}
-	return result
+	if message := decodeArchive(data); message != nil {
+		return message.Notification
+	}
+	return nil
+}
+
+func (s *kvStore) ScanMessages(app string, fn func(message *ArchivedMessage) bool) {
+	scanArchive(s.Scan, "", app, fn)
+}
+
+func (s *kvStore) DeleteMessage(app string, connectNum int32, msgID int32) {
+	s.Delete(messageKey(app, connectNum, msgID))
 }
 
-func getLatestIdentity() int32 {
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-	data, err := getDB().Get(ro, []byte("latest_indentity"))
+/**
+存档的key没有前缀，需要遍历所有的key。
+*/
+func (s *kvStore) MessageApps() []string {
+	return archivedApps(s.Scan, "")
+}
+
+func (s *kvStore) getCounter(key string) int32 {
+	data, err := s.backend.Get(key)
 	if err != nil {
-		log.Println("cannot get latest_indentity")
+		log.Println("cannot get", key)
+		return 0
+	}
+	if len(data) == 0 {
 		return 0
 	}
 	buf := bytes.NewBuffer(data)
 	var result int32
 	err = binary.Read(buf, binary.BigEndian, &result)
 	if err != nil {
-		log.Println("invalid indentity", err)
+		log.Println("invalid counter", key, err)
 		return 0
 	}
 	return result
 }
 
-func storeLatestIdentity(msgID int32) {
-	wo := levigo.NewWriteOptions()
-	defer wo.Close()
+func (s *kvStore) storeCounter(key string, value int32) {
 	buf := bytes.NewBuffer([]byte{})
-	binary.Write(buf, binary.BigEndian, msgID)
-	err := getDB().Put(wo, []byte("latest_indentity"), buf.Bytes())
-	if err != nil {
-		log.Println("error when store latestIdentity", err)
+	binary.Write(buf, binary.BigEndian, value)
+	if err := s.backend.Put(key, buf.Bytes()); err != nil {
+		log.Println("error when store", key, err)
 	}
 }
 
-func isBadToken(app string, token string) bool {
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-	value, err := getDB().Get(ro, []byte("BT:"+app+"_"+token))
+func (s *kvStore) Incr(key string, delta int32) int32 {
+	s.counterMutex.Lock()
+	defer s.counterMutex.Unlock()
+	current := s.getCounter(key)
+	next := delta
+	if current <= math.MaxInt32-delta {
+		next = current + delta
+	}
+	s.storeCounter(key, next)
+	return next
+}
+
+func (s *kvStore) BadTokenTime(app string, token string) int64 {
+	value, err := s.backend.Get(BAD_TOKEN_PREFIX + app + "_" + token)
 	if err != nil {
 		log.Println("error when test if an token is bad")
-		return false
-	}
-	if string(value) == "1" {
-		return true
+		return 0
 	}
+	return parseBadTokenTime(value)
+}
 
-	return false
+/**
+旧版本存的是"1"，新版本存的是失效时间。
+*/
+func parseBadTokenTime(value []byte) int64 {
+	if len(value) == 0 {
+		return 0
+	}
+	invalidAt, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || invalidAt <= 0 {
+		return 1
+	}
+	return invalidAt
 }
 
-func addBadToken(app string, token string) {
-	wo := levigo.NewWriteOptions()
-	defer wo.Close()
-	err := getDB().Put(wo, []byte("BT:"+app+"_"+token), []byte("1"))
-	if err != nil {
+func (s *kvStore) AddBadToken(app string, token string, invalidAt int64) {
+	if err := s.backend.Put(BAD_TOKEN_PREFIX+app+"_"+token, []byte(strconv.FormatInt(invalidAt, 10))); err != nil {
 		log.Println("error when add bad token to db")
 	}
 }
 
-func recoverToken(app string, token string) {
-	wo := levigo.NewWriteOptions()
-	defer wo.Close()
-	err := getDB().Delete(wo, []byte("BT:"+app+"_"+token))
-	if err != nil {
+func (s *kvStore) RecoverToken(app string, token string) {
+	if err := s.backend.Delete(BAD_TOKEN_PREFIX + app + "_" + token); err != nil {
 		log.Println("error when recover token")
 	}
 }
+
+func (s *kvStore) Put(key string, value []byte) {
+	if err := s.backend.Put(key, value); err != nil {
+		log.Println("error when put record", key, err)
+	}
+}
+
+func (s *kvStore) Get(key string) []byte {
+	data, err := s.backend.Get(key)
+	if err != nil {
+		log.Println("error when get record", key, err)
+		return nil
+	}
+	return data
+}
+
+func (s *kvStore) Delete(key string) {
+	if err := s.backend.Delete(key); err != nil {
+		log.Println("error when delete record", key, err)
+	}
+}
+
+func (s *kvStore) Scan(prefix string, fn func(key string, value []byte) bool) {
+	if err := s.backend.Scan(prefix, fn); err != nil {
+		log.Println("error when scan records", prefix, err)
+	}
+}
+
+func (s *kvStore) Claim(key string, ttl time.Duration) bool {
+	s.claimMutex.Lock()
+	defer s.claimMutex.Unlock()
+	now := time.Now()
+	if until, ok := s.claims[key]; ok && now.Before(until) {
+		return false
+	}
+	if s.claims == nil {
+		s.claims = make(map[string]time.Time)
+	}
+	for k, until := range s.claims {
+		if !now.Before(until) {
+			delete(s.claims, k)
+		}
+	}
+	s.claims[key] = now.Add(ttl)
+	return true
+}
+
+func (s *kvStore) Close() {
+	if err := s.backend.Close(); err != nil {
+		log.Println("error when close database", err)
+	}
+}
+
+/**
+以下函数沿用原来的调用方式，实际由当前的Store完成。
+*/
+func StoreMessage(notification *Notification, msgID int32, connectNum int32) {
+	getStore().StoreMessage(notification, msgID, connectNum)
+}
+
+func GetMessage(app string, connectNum int32, identifier int32) *Notification {
+	return getStore().GetMessage(app, connectNum, identifier)
+}
+
+func GetMessages(app string, connectNum int32, identifiers []int32) []*Notification {
+	log.Printf("get %d messages of connection %d", len(identifiers), connectNum)
+	result := make([]*Notification, len(identifiers))
+	for i, id := range identifiers {
+		log.Println("get message with id", id)
+		result[i] = GetMessage(app, connectNum, id)
+	}
+	return result
+}
+
+func incrCounter(key string, delta int32) int32 {
+	return getStore().Incr(key, delta)
+}
+
+func isBadToken(app string, token string) bool {
+	return getStore().BadTokenTime(app, token) != 0
+}
+
+func badTokenTime(app string, token string) int64 {
+	return getStore().BadTokenTime(app, token)
+}
+
+func addBadToken(app string, token string, invalidAt int64) {
+	getStore().AddBadToken(app, token, invalidAt)
+}
+
+func recoverToken(app string, token string) {
+	getStore().RecoverToken(app, token)
+}
+
+func putRecord(key string, value []byte) {
+	getStore().Put(key, value)
+}
+
+func getRecord(key string) []byte {
+	return getStore().Get(key)
+}
+
+func deleteRecord(key string) {
+	getStore().Delete(key)
+}
+
+func scanRecords(prefix string, fn func(key string, value []byte) bool) {
+	getStore().Scan(prefix, fn)
+}
+
+func claimRecord(key string, ttl time.Duration) bool {
+	return getStore().Claim(key, ttl)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"go.etcd.io/bbolt"
+	"os"
+	"path"
+	"time"
+)
+
+/**
+* bbolt后端，纯Go实现，数据存在DbPath目录下的goapns.bolt文件中。
+ */
+
+const BOLT_FILE_NAME = "goapns.bolt"
+
+var boltBucket = []byte("goapns")
+
+func init() {
+	storeBackends[STORE_BOLT] = openBolt
+}
+
+type boltBackend struct {
+	db *bbolt.DB
+}
+
+func openBolt(config *AppConfig) (Store, error) {
+	if err := os.MkdirAll(config.DbPath, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path.Join(config.DbPath, BOLT_FILE_NAME), 0600, &bbolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &kvStore{backend: &boltBackend{db}}, nil
+}
+
+func (b *boltBackend) Put(key string, value []byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltBackend) Get(key string) ([]byte, error) {
+	var result []byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		// bolt返回的数据只在事务内有效，需要复制一份。
+		if value := tx.Bucket(boltBucket).Get([]byte(key)); value != nil {
+			result = append([]byte{}, value...)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (b *boltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+/**
+遍历在只读事务中进行，fn里不能再写数据库，否则会死锁，所以先收集结果再回调。
+*/
+func (b *boltBackend) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	var keys []string
+	var values [][]byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			keys = append(keys, string(k))
+			values = append(values, append([]byte{}, v...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if !fn(key, values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
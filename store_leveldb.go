@@ -0,0 +1,77 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"strings"
+)
+
+/**
+* LevelDB后端，依赖cgo及levigo。
+ */
+
+func init() {
+	storeBackends[STORE_LEVELDB] = openLevelDB
+}
+
+type levelDBBackend struct {
+	db    *levigo.DB
+	cache *levigo.Cache
+}
+
+func openLevelDB(config *AppConfig) (Store, error) {
+	cache := levigo.NewLRUCache(int(config.DbCacheMB) << 20)
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCache(cache)
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(config.DbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{backend: &levelDBBackend{db, cache}}, nil
+}
+
+func (b *levelDBBackend) Put(key string, value []byte) error {
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	return b.db.Put(wo, []byte(key), value)
+}
+
+func (b *levelDBBackend) Get(key string) ([]byte, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	return b.db.Get(ro, []byte(key))
+}
+
+func (b *levelDBBackend) Delete(key string) error {
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	return b.db.Delete(wo, []byte(key))
+}
+
+func (b *levelDBBackend) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Close()
+	it := b.db.NewIterator(ro)
+	defer it.Close()
+	for it.Seek([]byte(prefix)); it.Valid(); it.Next() {
+		key := string(it.Key())
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if !fn(key, it.Value()) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+func (b *levelDBBackend) Close() error {
+	b.db.Close()
+	b.cache.Close()
+	return nil
+}
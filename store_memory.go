@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+* 内存后端，进程退出后数据丢失，用于测试及不需要持久化的场合。
+ */
+
+func init() {
+	storeBackends[STORE_MEMORY] = openMemoryStore
+}
+
+type memoryBackend struct {
+	mutex sync.RWMutex
+	data  map[string][]byte
+}
+
+func openMemoryStore(config *AppConfig) (Store, error) {
+	return NewMemoryStore(), nil
+}
+
+func NewMemoryStore() Store {
+	return &kvStore{backend: &memoryBackend{data: make(map[string][]byte)}}
+}
+
+func (b *memoryBackend) Put(key string, value []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBackend) Get(key string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.data[key], nil
+}
+
+func (b *memoryBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.data, key)
+	return nil
+}
+
+func (b *memoryBackend) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	b.mutex.RLock()
+	var keys []string
+	for key := range b.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = b.data[key]
+	}
+	b.mutex.RUnlock()
+
+	for i, key := range keys {
+		if !fn(key, values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/redis.v2"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+* Redis后端，多个goapns实例共用同一个Redis时，bad token、消息存档及消息ID在实例间共享。
+* 所有key都加上goapns:前缀，消息存档在RedisArchiveTTLSecs后自动过期。
+* 每类记录（按key中第一个":"之前的前缀区分）都登记在goapns:idx:<前缀>这个有序集合中，
+* Scan只遍历对应的索引，不必SCAN整个keyspace。
+ */
+
+const (
+	REDIS_KEY_PREFIX      = "goapns:"
+	REDIS_MESSAGE_PREFIX  = REDIS_KEY_PREFIX + "msg:"
+	REDIS_SCAN_BATCH_SIZE = 1000
+	REDIS_INDEX_PREFIX    = REDIS_KEY_PREFIX + "idx:"
+	REDIS_INDEX_BUILT_KEY = REDIS_KEY_PREFIX + "idx-built"
+
+	// SET NX PX，只有key不存在时才写入并设置过期时间
+	REDIS_CLAIM_SCRIPT = `return redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])`
+
+	// 写入记录（ARGV[2]不为0时设置过期毫秒数），同时登记到索引
+	REDIS_PUT_SCRIPT = `
+if ARGV[2] ~= "0" then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+redis.call("ZADD", KEYS[2], 0, ARGV[3])
+return 1`
+
+	// 删除记录，同时从索引中移除
+	REDIS_DELETE_SCRIPT = `
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+return 1`
+
+	// 按字典序取索引中的一页key
+	REDIS_RANGE_SCRIPT = `return redis.call("ZRANGEBYLEX", KEYS[1], ARGV[1], ARGV[2], "LIMIT", 0, ARGV[3])`
+
+	// 超出ARGV[2]时从ARGV[1]重新开始，与kvStore一致，且每次取到的都是完整的一段
+	REDIS_INCR_SCRIPT = `
+local value = redis.call("INCRBY", KEYS[1], ARGV[1])
+if value > tonumber(ARGV[2]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+	return tonumber(ARGV[1])
+end
+return value`
+)
+
+/**
+需要Scan的记录前缀，旧版本写入的记录在打开时补登记到索引。
+*/
+var redisIndexedPrefixes = []string{
+	BAD_TOKEN_PREFIX,
+	REGISTRATION_PREFIX,
+	MESSAGE_STATUS_PREFIX,
+	TOKEN_MESSAGE_PREFIX,
+	WEBHOOK_OUTBOX_PREFIX,
+	strings.TrimPrefix(REDIS_MESSAGE_PREFIX, REDIS_KEY_PREFIX),
+}
+
+func init() {
+	storeBackends[STORE_REDIS] = openRedisStore
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewTCPClient(&redis.Options{
+		Addr:        fmt.Sprintf("%s:%d", appConfig.RedisHost, appConfig.RedisPort),
+		Password:    appConfig.RedisPassword,
+		DB:          appConfig.RedisDB,
+		PoolSize:    int(appConfig.RedisPoolsize),
+		DialTimeout: 10 * time.Second,
+	})
+}
+
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func openRedisStore(config *AppConfig) (Store, error) {
+	client := newRedisClient()
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	s := &redisStore{client, time.Duration(config.RedisArchiveTTLSecs) * time.Second}
+	s.buildIndexes()
+	return s, nil
+}
+
+/**
+索引的key，如MS:xxx登记在goapns:idx:MS:中。
+*/
+func redisIndexKey(key string) string {
+	return REDIS_INDEX_PREFIX + key[:strings.Index(key, ":")+1]
+}
+
+/**
+把还没登记的旧记录补进索引，只在第一次使用新版本时SCAN一次。
+*/
+func (s *redisStore) buildIndexes() {
+	if s.client.Exists(REDIS_INDEX_BUILT_KEY).Val() {
+		return
+	}
+	log.Println("build redis indexes")
+	for _, prefix := range redisIndexedPrefixes {
+		var cursor int64
+		for {
+			next, keys, err := s.client.Scan(cursor, escapeRedisPattern(REDIS_KEY_PREFIX+prefix)+"*", REDIS_SCAN_BATCH_SIZE).Result()
+			if err != nil {
+				log.Println("error when build redis index", prefix, err)
+				return
+			}
+			if len(keys) > 0 {
+				members := make([]redis.Z, len(keys))
+				for i, key := range keys {
+					members[i] = redis.Z{Score: 0, Member: strings.TrimPrefix(key, REDIS_KEY_PREFIX)}
+				}
+				if err := s.client.ZAdd(REDIS_INDEX_PREFIX+prefix, members...).Err(); err != nil {
+					log.Println("error when build redis index", prefix, err)
+					return
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	if err := s.client.Set(REDIS_INDEX_BUILT_KEY, "1").Err(); err != nil {
+		log.Println("error when mark redis indexes built", err)
+	}
+}
+
+/**
+key不带goapns:前缀，ttl为0时不过期。
+*/
+func (s *redisStore) put(key string, value string, ttl time.Duration) error {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	return s.client.Eval(REDIS_PUT_SCRIPT, []string{REDIS_KEY_PREFIX + key, redisIndexKey(key)},
+		[]string{value, ms, key}).Err()
+}
+
+func (s *redisStore) del(key string) error {
+	return s.client.Eval(REDIS_DELETE_SCRIPT, []string{REDIS_KEY_PREFIX + key, redisIndexKey(key)},
+		[]string{key}).Err()
+}
+
+func (s *redisStore) StoreMessage(notification *Notification, msgID int32, connectNum int32) {
+	key := messageKey(notification.App, connectNum, msgID)
+	log.Println("store message to redis ", key)
+	data := encodeArchive(notification)
+	if data == nil {
+		return
+	}
+	err := s.put(strings.TrimPrefix(REDIS_MESSAGE_PREFIX, REDIS_KEY_PREFIX)+key, string(data), s.ttl)
+	if err != nil {
+		log.Println("can not store message to redis", err)
+	}
+}
+
+func (s *redisStore) GetMessage(app string, connectNum int32, msgID int32) *Notification {
+	message := decodeArchive(s.get(REDIS_MESSAGE_PREFIX + messageKey(app, connectNum, msgID)))
+	if message == nil {
+		return nil
+	}
+	return message.Notification
+}
+
+/**
+存档的key在REDIS_MESSAGE_PREFIX下，Scan会自动加上REDIS_KEY_PREFIX。
+*/
+func (s *redisStore) ScanMessages(app string, fn func(message *ArchivedMessage) bool) {
+	scanArchive(s.Scan, strings.TrimPrefix(REDIS_MESSAGE_PREFIX, REDIS_KEY_PREFIX), app, fn)
+}
+
+func (s *redisStore) MessageApps() []string {
+	return archivedApps(s.Scan, strings.TrimPrefix(REDIS_MESSAGE_PREFIX, REDIS_KEY_PREFIX))
+}
+
+func (s *redisStore) DeleteMessage(app string, connectNum int32, msgID int32) {
+	if err := s.del(strings.TrimPrefix(REDIS_MESSAGE_PREFIX, REDIS_KEY_PREFIX) + messageKey(app, connectNum, msgID)); err != nil {
+		log.Println("error when delete message", err)
+	}
+}
+
+func (s *redisStore) Incr(key string, delta int32) int32 {
+	value, err := s.client.Eval(REDIS_INCR_SCRIPT, []string{REDIS_KEY_PREFIX + key},
+		[]string{strconv.FormatInt(int64(delta), 10), strconv.FormatInt(math.MaxInt32, 10)}).Result()
+	if err != nil {
+		log.Println("can not increase counter in redis", key, err)
+		return 0
+	}
+	next, ok := value.(int64)
+	if !ok {
+		log.Println("unexpected counter value in redis", key, value)
+		return 0
+	}
+	return int32(next)
+}
+
+func (s *redisStore) BadTokenTime(app string, token string) int64 {
+	return parseBadTokenTime(s.get(REDIS_KEY_PREFIX + BAD_TOKEN_PREFIX + app + "_" + token))
+}
+
+func (s *redisStore) AddBadToken(app string, token string, invalidAt int64) {
+	err := s.put(BAD_TOKEN_PREFIX+app+"_"+token, strconv.FormatInt(invalidAt, 10), 0)
+	if err != nil {
+		log.Println("error when add bad token to redis", err)
+	}
+}
+
+func (s *redisStore) RecoverToken(app string, token string) {
+	if err := s.del(BAD_TOKEN_PREFIX + app + "_" + token); err != nil {
+		log.Println("error when recover token", err)
+	}
+}
+
+func (s *redisStore) Put(key string, value []byte) {
+	if err := s.put(key, string(value), 0); err != nil {
+		log.Println("error when put record", key, err)
+	}
+}
+
+func (s *redisStore) get(key string) []byte {
+	value, err := s.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		log.Println("error when get record", key, err)
+		return nil
+	}
+	return []byte(value)
+}
+
+func (s *redisStore) Get(key string) []byte {
+	return s.get(REDIS_KEY_PREFIX + key)
+}
+
+func (s *redisStore) Delete(key string) {
+	if err := s.del(key); err != nil {
+		log.Println("error when delete record", key, err)
+	}
+}
+
+/**
+按字典序分页遍历索引，每页用MGET取值，值已不存在（如存档过期）的key顺便从索引中移除。
+*/
+func (s *redisStore) Scan(prefix string, fn func(key string, value []byte) bool) {
+	index := redisIndexKey(prefix)
+	start := "[" + prefix
+	end := "(" + prefix + "\xff"
+	for {
+		result, err := s.client.Eval(REDIS_RANGE_SCRIPT, []string{index},
+			[]string{start, end, strconv.Itoa(REDIS_SCAN_BATCH_SIZE)}).Result()
+		if err != nil {
+			log.Println("error when scan records", prefix, err)
+			return
+		}
+		items, _ := result.([]interface{})
+		if len(items) == 0 {
+			return
+		}
+		keys := make([]string, 0, len(items))
+		fullKeys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+				fullKeys = append(fullKeys, REDIS_KEY_PREFIX+key)
+			}
+		}
+		values, err := s.client.MGet(fullKeys...).Result()
+		if err != nil {
+			log.Println("error when scan records", prefix, err)
+			return
+		}
+		var stale []string
+		for i, key := range keys {
+			value, ok := values[i].(string)
+			if !ok {
+				stale = append(stale, key)
+				continue
+			}
+			if !fn(key, []byte(value)) {
+				s.removeStale(index, stale)
+				return
+			}
+		}
+		s.removeStale(index, stale)
+		if len(items) < REDIS_SCAN_BATCH_SIZE {
+			return
+		}
+		start = "(" + keys[len(keys)-1]
+	}
+}
+
+func (s *redisStore) removeStale(index string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := s.client.ZRem(index, keys...).Err(); err != nil {
+		log.Println("error when clean redis index", index, err)
+	}
+}
+
+func (s *redisStore) Claim(key string, ttl time.Duration) bool {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	err := s.client.Eval(REDIS_CLAIM_SCRIPT, []string{REDIS_KEY_PREFIX + key}, []string{"1", ms}).Err()
+	if err == redis.Nil {
+		return false
+	}
+	if err != nil {
+		log.Println("error when claim record", key, err)
+		return false
+	}
+	return true
+}
+
+func escapeRedisPattern(s string) string {
+	var buf bytes.Buffer
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			buf.WriteRune('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func (s *redisStore) Close() {
+	if err := s.client.Close(); err != nil {
+		log.Println("error when close redis client", err)
+	}
+}
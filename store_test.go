@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goapns-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{STORE_MEMORY, STORE_BOLT} {
+		s, err := storeBackends[name](&AppConfig{DbPath: dir, DbCacheMB: 1})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		s.StoreMessage(&Notification{App: "com.a", Token: "t1", Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}, 5, 2)
+		if message := s.GetMessage("com.a", 2, 5); message == nil || message.Token != "t1" {
+			t.Errorf("%s: stored message is %+v", name, message)
+		}
+		if s.GetMessage("com.a", 2, 6) != nil || s.GetMessage("com.b", 2, 5) != nil {
+			t.Errorf("%s: got a message that was not stored", name)
+		}
+		s.DeleteMessage("com.a", 2, 5)
+		if s.GetMessage("com.a", 2, 5) != nil {
+			t.Errorf("%s: message is not deleted", name)
+		}
+
+		if s.Incr("counter", 1) != 1 || s.Incr("counter", 41) != 42 {
+			t.Errorf("%s: counter is not increased", name)
+		}
+
+		s.AddBadToken("com.a", "x", 100)
+		if s.BadTokenTime("com.a", "x") != 100 || s.BadTokenTime("com.a", "y") != 0 {
+			t.Errorf("%s: bad token time is not recorded", name)
+		}
+		s.RecoverToken("com.a", "x")
+		if s.BadTokenTime("com.a", "x") != 0 {
+			t.Errorf("%s: token is not recovered", name)
+		}
+
+		s.Put("P:2", []byte("2"))
+		s.Put("P:1", []byte("1"))
+		s.Put("Q:1", []byte("q"))
+		var scanned string
+		s.Scan("P:", func(key string, value []byte) bool {
+			scanned += key + "=" + string(value) + ";"
+			s.Delete(key)
+			return true
+		})
+		if scanned != "P:1=1;P:2=2;" || s.Get("P:1") != nil || string(s.Get("Q:1")) != "q" {
+			t.Errorf("%s: scanned %s", name, scanned)
+		}
+
+		if !s.Claim("lock", time.Minute) || s.Claim("lock", time.Minute) {
+			t.Errorf("%s: key is claimed twice", name)
+		}
+		if !s.Claim("expired", time.Millisecond) {
+			t.Errorf("%s: can not claim a new key", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if !s.Claim("expired", time.Minute) {
+			t.Errorf("%s: expired claim is not released", name)
+		}
+		s.Close()
+	}
+}
+
+/**
+需要本机的Redis，连不上时跳过。使用15号库，只读写redistest开头的记录。
+*/
+func TestRedisStore(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.RedisDB = 15
+	s, err := openRedisStore(&appConfig)
+	if err != nil {
+		t.Skip("redis is not available: ", err)
+	}
+	defer s.Close()
+	client := s.(*redisStore).client
+
+	s.Put("MS:redistest_2", []byte("2"))
+	s.Put("MS:redistest_1", []byte("1"))
+	s.Put("MS:redistest_3", []byte("3"))
+	s.Put("MT:redistest_1", []byte("t"))
+	client.Del(REDIS_KEY_PREFIX + "MS:redistest_3")
+	var scanned string
+	s.Scan("MS:redistest_", func(key string, value []byte) bool {
+		scanned += key + "=" + string(value) + ";"
+		s.Delete(key)
+		return true
+	})
+	if scanned != "MS:redistest_1=1;MS:redistest_2=2;" {
+		t.Errorf("scanned %s", scanned)
+	}
+	members, _ := client.ZRange(REDIS_INDEX_PREFIX+"MS:", 0, -1).Result()
+	for _, member := range members {
+		if strings.HasPrefix(member, "MS:redistest_") {
+			t.Errorf("%s is left in the index", member)
+		}
+	}
+	if string(s.Get("MT:redistest_1")) != "t" {
+		t.Error("record of another prefix is scanned")
+	}
+	s.Delete("MT:redistest_1")
+
+	s.StoreMessage(&Notification{App: "redistest.app", Token: "t1", Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}, 5, 2)
+	var archived []string
+	s.ScanMessages("redistest.app", func(message *ArchivedMessage) bool {
+		archived = append(archived, message.Notification.Token)
+		return true
+	})
+	if len(archived) != 1 || archived[0] != "t1" {
+		t.Errorf("archived messages are %v", archived)
+	}
+	s.DeleteMessage("redistest.app", 2, 5)
+
+	// 旧版本写入的记录在重建索引后也能遍历到
+	client.Set(REDIS_KEY_PREFIX+BAD_TOKEN_PREFIX+"redistest.app_old", "100")
+	client.Del(REDIS_INDEX_BUILT_KEY)
+	s.(*redisStore).buildIndexes()
+	var tokens string
+	s.Scan(BAD_TOKEN_PREFIX+"redistest.app_", func(key string, value []byte) bool {
+		tokens += key + ";"
+		return true
+	})
+	if tokens != BAD_TOKEN_PREFIX+"redistest.app_old;" {
+		t.Errorf("scanned bad tokens %s", tokens)
+	}
+	s.RecoverToken("redistest.app", "old")
+
+	counter := "redistest-counter"
+	client.Set(REDIS_KEY_PREFIX+counter, strconv.FormatInt(math.MaxInt32-5, 10))
+	if next := s.Incr(counter, 10); next != 10 {
+		t.Errorf("counter wraps to %d", next)
+	}
+	if next := s.Incr(counter, 10); next != 20 {
+		t.Errorf("counter is %d after wrap", next)
+	}
+	client.Del(REDIS_KEY_PREFIX + counter)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/**
+* 重连的管理。每个slot的连接失败后按该slot连续失败的次数指数退避（加随机抖动）重试，直到连上为止。
+* 一个应用（sandbox单独计算）的每个slot都连续失败CircuitBreakFailures次后熔断，认为该应用暂时不可用，
+* 只要还有一个slot可用，消息就由其他连接发送：
+* 新的推送请求直接返回503，Redis队列中的消息留在队列里，已接收的消息在等待队列中等连接恢复后再发。
+* 等待队列最多PendingBufferSize条，满了之后新的消息被丢弃。
+ */
+
+const RECONNECT_BASE_DELAY = time.Second
+
+type circuitBreaker struct {
+	failures  map[int]int       // 每个slot连续失败的次数
+	lastError string            // 最后一次失败的原因
+	retryAt   map[int]time.Time // 每个slot下一次重试的时间
+	pending   map[int]bool      // 已安排重试的slot
+}
+
+var breakers map[string]*circuitBreaker = make(map[string]*circuitBreaker)
+var breakersMutex sync.Mutex
+
+func breakerFor(key string) *circuitBreaker {
+	breaker := breakers[key]
+	if breaker == nil {
+		breaker = &circuitBreaker{failures: make(map[int]int), retryAt: make(map[int]time.Time), pending: make(map[int]bool)}
+		breakers[key] = breaker
+	}
+	return breaker
+}
+
+/**
+连接池的slot都已熔断，size为连接池的大小。
+*/
+func (breaker *circuitBreaker) open(size int) bool {
+	if appConfig.CircuitBreakFailures <= 0 {
+		return false
+	}
+	if size < 1 {
+		size = 1
+	}
+	for slot := 0; slot < size; slot++ {
+		if breaker.failures[slot] < int(appConfig.CircuitBreakFailures) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+应用连接池的大小，连接池还没建立时为1。
+*/
+func poolSize(key string) int {
+	if pool := getPool(key); pool != nil {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+		return len(pool.conns)
+	}
+	return 1
+}
+
+/**
+第failures次失败后等待的时间：以RECONNECT_BASE_DELAY为起点每次翻倍，不超过ReconnectMaxSecs，
+实际等待时间在其一半到全部之间随机，避免多个连接同时重连。
+*/
+func backoffDelay(failures int) time.Duration {
+	max := time.Duration(appConfig.ReconnectMaxSecs) * time.Second
+	delay := RECONNECT_BASE_DELAY
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+/**
+连接失败，安排该slot稍后重试。key为sockets的key。
+*/
+func connectFailed(key string, sandbox bool, slot int, err error) {
+	size := poolSize(key)
+	breakersMutex.Lock()
+	breaker := breakerFor(key)
+	wasOpen := breaker.open(size)
+	breaker.failures[slot]++
+	breaker.lastError = err.Error()
+	failures := breaker.failures[slot]
+	delay := backoffDelay(failures)
+	breaker.retryAt[slot] = time.Now().Add(delay)
+	scheduled := breaker.pending[slot]
+	breaker.pending[slot] = true
+	open := breaker.open(size)
+	breakersMutex.Unlock()
+
+	if open && !wasOpen {
+		log.Printf("circuit of %s is open, all %d connections failed: %s", key, size, err)
+	}
+	FireWebhook(key, WEBHOOK_EVENT_CONNECTION_FAILURE, map[string]interface{}{
+		"reason": err.Error(), "slot": slot, "failures": failures, "circuit_open": open})
+	if scheduled {
+		return
+	}
+	log.Printf("reconnect %s slot %d in %s", key, slot, delay)
+	time.AfterFunc(delay, func() {
+		retryConnect(key, sandbox, slot)
+	})
+}
+
+func retryConnect(key string, sandbox bool, slot int) {
+	defer CapturePanic("fail to reconnect " + key)
+	breakersMutex.Lock()
+	delete(breakerFor(key).pending, slot)
+	breakersMutex.Unlock()
+
+	// 应用已被移除，不再重试
+	knownAppsMutex.Lock()
+	_, known := knownApps[key]
+	removed := knownApps != nil && !known
+	knownAppsMutex.Unlock()
+	if removed {
+		log.Println("app removed, stop reconnecting", key)
+		return
+	}
+	// 重试前已经连上了（如证书更新后重建了连接）
+	if pool := getPool(key); pool != nil && pool.SlotConnected(slot) {
+		return
+	}
+	connectSlot(key, sandbox, slot)
+}
+
+/**
+slot的连接成功或HTTP/2通道收到苹果的响应，重置该slot的失败次数，熔断随之恢复。
+*/
+func connectSucceeded(key string, slot int) {
+	size := poolSize(key)
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker := breakers[key]
+	if breaker == nil || breaker.failures[slot] == 0 {
+		return
+	}
+	if breaker.open(size) {
+		log.Printf("circuit of %s is closed, connection of slot %d recovered", key, slot)
+	}
+	delete(breaker.failures, slot)
+	delete(breaker.retryAt, slot)
+	if len(breaker.failures) == 0 {
+		breaker.lastError = ""
+	}
+}
+
+func circuitOpen(key string) bool {
+	return len(circuitProblem(key)) != 0
+}
+
+/**
+熔断时返回原因，否则返回空字符串。
+*/
+func circuitProblem(key string) string {
+	if appConfig.CircuitBreakFailures <= 0 {
+		return ""
+	}
+	size := poolSize(key)
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker := breakers[key]
+	if breaker == nil || !breaker.open(size) {
+		return ""
+	}
+	return fmt.Sprintf("all %d connections to apns are down after %d failures each: %s",
+		size, appConfig.CircuitBreakFailures, breaker.lastError)
+}
+
+/**
+离最早的一个slot下一次重试的秒数，用于Retry-After。
+*/
+func circuitRetryAfter(key string) int {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker := breakers[key]
+	if breaker == nil || len(breaker.retryAt) == 0 {
+		return 0
+	}
+	var retryAt time.Time
+	for _, at := range breaker.retryAt {
+		if retryAt.IsZero() || at.Before(retryAt) {
+			retryAt = at
+		}
+	}
+	seconds := int(time.Until(retryAt).Seconds()) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+/**
+应用暂时不能接收新消息的原因：证书有问题、熔断或等待队列已满。可以接收时返回空字符串。
+*/
+func appUnavailable(key string) string {
+	if problem := certificateProblem(key); len(problem) != 0 {
+		return problem
+	}
+	if problem := circuitProblem(key); len(problem) != 0 {
+		return problem
+	}
+	if pendingBufferFull(key) {
+		return fmt.Sprintf("too many pending messages (%d)", appConfig.PendingBufferSize)
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCircuitOpensWhenAllSlotsFail(t *testing.T) {
+	appConfig = NewConfig()
+	appConfig.ConnectionsPerApp = 2
+	store = NewMemoryStore()
+	defer closeStore()
+	ensurePool("com.slots", false)
+	defer removePool("com.slots")
+	// 不真的去重连
+	breakersMutex.Lock()
+	breakerFor("com.slots").pending[0] = true
+	breakerFor("com.slots").pending[1] = true
+	breakersMutex.Unlock()
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, "com.slots")
+		breakersMutex.Unlock()
+	}()
+
+	err := errors.New("connection refused")
+	for i := 0; i < int(appConfig.CircuitBreakFailures); i++ {
+		connectFailed("com.slots", false, 0, err)
+	}
+	if circuitOpen("com.slots") {
+		t.Fatal("circuit is open while slot 1 is still up")
+	}
+	for i := 0; i < int(appConfig.CircuitBreakFailures); i++ {
+		connectFailed("com.slots", false, 1, err)
+	}
+	if !circuitOpen("com.slots") {
+		t.Fatal("circuit is not open after all slots failed")
+	}
+	if circuitRetryAfter("com.slots") < 1 {
+		t.Error("retry after is not set")
+	}
+	connectSucceeded("com.slots", 1)
+	if circuitOpen("com.slots") {
+		t.Fatal("circuit is still open after slot 1 recovered")
+	}
+}
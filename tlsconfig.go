@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/**
+* 连接苹果服务器时的TLS校验。默认用系统的根证书校验服务器证书，
+* 配置了TLSCAFile时改用该文件中的根证书（用于本地的测试服务器），
+* 配置了TLSPins时，证书链中至少要有一个证书的公钥与其中之一相同。
+ */
+
+type pinMismatchError struct {
+	Server string
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("no public key in the certificate chain of %s matches TLSPins", e.Server)
+}
+
+/**
+创建连接苹果服务器用的TLS配置，certificates为客户端证书，Token认证时为空。
+*/
+func newTLSConfig(certificates []tls.Certificate) (*tls.Config, error) {
+	config := &tls.Config{Certificates: certificates}
+	if len(appConfig.TLSCAFile) != 0 {
+		content, err := ioutil.ReadFile(appConfig.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read TLSCAFile: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in TLSCAFile %s", appConfig.TLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(appConfig.TLSPins) != 0 {
+		pins := make(map[string]bool)
+		for _, pin := range appConfig.TLSPins {
+			pins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state, pins)
+		}
+	}
+	return config, nil
+}
+
+/**
+VerifyConnection在证书链校验通过后调用，检查链中是否有固定的公钥。
+*/
+func verifyPins(state tls.ConnectionState, pins map[string]bool) error {
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+	return &pinMismatchError{state.ServerName}
+}
+
+/**
+证书公钥（SubjectPublicKeyInfo）的SHA-256，base64编码，与curl的--pinnedpubkey格式相同。
+*/
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+/**
+服务器证书校验失败时返回更清楚的错误，其他错误原样返回。
+*/
+func describeTLSError(err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	var pinErr *pinMismatchError
+	if errors.As(err, &verifyErr) || errors.As(err, &pinErr) {
+		return fmt.Errorf("can not verify APNs server certificate, the connection may be intercepted: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPins(t *testing.T) {
+	cert := newTestCertificate(t).Leaf
+	other := newTestCertificate(t).Leaf
+	state := tls.ConnectionState{ServerName: "api.push.apple.com", VerifiedChains: [][]*x509.Certificate{{other, cert}}}
+
+	if err := verifyPins(state, map[string]bool{spkiHash(cert): true}); err != nil {
+		t.Fatal("pinned key in the chain is rejected:", err)
+	}
+	err := verifyPins(state, map[string]bool{spkiHash(newTestCertificate(t).Leaf): true})
+	if err == nil || !strings.Contains(err.Error(), "api.push.apple.com") {
+		t.Fatal("unpinned chain is accepted:", err)
+	}
+	if described := describeTLSError(err); !strings.Contains(described.Error(), "can not verify") {
+		t.Fatal("pin mismatch is not described:", described)
+	}
+	if verifyPins(tls.ConnectionState{}, map[string]bool{spkiHash(cert): true}) == nil {
+		t.Fatal("connection without verified chains is accepted")
+	}
+}
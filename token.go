@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* 基于Token(.p8)的Provider认证。一个ES256签名密钥可用于同一个Team下的所有应用，
+* 无需每年更新证书。签出的JWT有效期为一小时，这里在到期前主动刷新，
+* 同时苹果不允许频繁更换token，所以同一个密钥的token在进程内缓存复用。
+ */
+
+var tokenSigners map[string]*TokenSigner = make(map[string]*TokenSigner)
+var tokenSignersMutex sync.Mutex
+
+type TokenSigner struct {
+	TeamID   string
+	KeyID    string
+	key      *ecdsa.PrivateKey
+	token    string
+	issuedAt int64
+	mutex    sync.Mutex
+}
+
+/**
+在目录中查找AuthKey_<KeyID>.p8，找不到时返回空字符串。
+*/
+func findAuthKey(dir string) string {
+	matches, err := filepath.Glob(path.Join(dir, AUTH_KEY_FILE_PREFIX+"*"+AUTH_KEY_FILE_SUFFIX))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+/**
+加载应用的签名密钥，依次查找环境目录（develop/production）及应用目录。
+应用没有使用Token认证时返回nil, nil。
+*/
+func loadTokenSigner(app string, folder string, options AppOptions) (*TokenSigner, error) {
+	keyFile := findAuthKey(folder)
+	if len(keyFile) == 0 {
+		keyFile = findAuthKey(path.Join(appConfig.AppsDir, app))
+	}
+	if len(keyFile) == 0 {
+		return nil, nil
+	}
+
+	keyID := options.KeyID
+	if len(keyID) == 0 {
+		keyID = strings.TrimSuffix(strings.TrimPrefix(path.Base(keyFile), AUTH_KEY_FILE_PREFIX), AUTH_KEY_FILE_SUFFIX)
+	}
+	if len(options.TeamID) == 0 {
+		return nil, fmt.Errorf("TeamID is required in %s for token based app %s", APP_OPTIONS_FILE_NAME, app)
+	}
+
+	tokenSignersMutex.Lock()
+	defer tokenSignersMutex.Unlock()
+	cacheKey := options.TeamID + ":" + keyID
+	if signer := tokenSigners[cacheKey]; signer != nil {
+		return signer, nil
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAuthKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth key %s: %s", keyFile, err)
+	}
+	signer := &TokenSigner{TeamID: options.TeamID, KeyID: keyID, key: key}
+	tokenSigners[cacheKey] = signer
+	return signer, nil
+}
+
+func parseAuthKey(content []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA private key")
+	}
+	return ecKey, nil
+}
+
+/**
+返回当前有效的bearer token，快到期时重新签发。
+*/
+func (signer *TokenSigner) Token() (string, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+
+	now := time.Now().Unix()
+	if len(signer.token) != 0 && now-signer.issuedAt < TOKEN_REFRESH_SECS {
+		return signer.token, nil
+	}
+
+	token, err := signer.sign(now)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("issue new provider token for team %s key %s", signer.TeamID, signer.KeyID)
+	signer.token = token
+	signer.issuedAt = now
+	return token, nil
+}
+
+/**
+苹果返回ExpiredProviderToken时，丢弃缓存的token，下次使用时重新签发。
+token为被拒绝的请求使用的token，同时被拒绝的多个请求只有第一个会丢弃，已经换了新token时不再丢弃。
+*/
+func (signer *TokenSigner) Expire(token string) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	if signer.token == token {
+		signer.token = ""
+	}
+}
+
+func (signer *TokenSigner) sign(issuedAt int64) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": signer.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": signer.TeamID, "iat": issuedAt})
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS要求签名为定长的r||s，各32字节。
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
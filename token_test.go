@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTokenSigner(t *testing.T) {
+	appConfig = NewConfig()
+	setupAppsDir(t, map[string]string{"com.token": `{"TeamID": "TEAMTOKEN"}`})
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(appConfig.AppsDir, "com.token", AUTH_KEY_FILE_PREFIX+"ABC123"+AUTH_KEY_FILE_SUFFIX)
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 签名密钥按team及key缓存在进程内
+	defer func() {
+		tokenSignersMutex.Lock()
+		delete(tokenSigners, "TEAMTOKEN:ABC123")
+		tokenSignersMutex.Unlock()
+	}()
+	signer, err := loadTokenSigner("com.token", appFolder("com.token", false), loadAppOptions("com.token"))
+	if err != nil || signer == nil {
+		t.Fatal("can not load signer", err)
+	}
+	if signer.KeyID != "ABC123" || signer.TeamID != "TEAMTOKEN" {
+		t.Fatalf("signer is %s/%s", signer.TeamID, signer.KeyID)
+	}
+	first, _ := signer.Token()
+	if second, _ := signer.Token(); second != first {
+		t.Fatal("token is not cached")
+	}
+	// 使用旧token的请求被拒绝时，不丢弃已经换过的token
+	signer.Expire("stale")
+	if current, _ := signer.Token(); current != first {
+		t.Fatal("token is expired by a stale response")
+	}
+	signer.Expire(first)
+	if current, _ := signer.Token(); current == first {
+		t.Fatal("expired token is used again")
+	}
+
+	encoding := base64.RawURLEncoding
+	// r、s有前导0时也要补足32字节，多签几次
+	for i := 0; i < 100; i++ {
+		token, err := signer.sign(1700000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			t.Fatalf("malformed token %s", token)
+		}
+		var header, claims map[string]interface{}
+		headerJson, _ := encoding.DecodeString(parts[0])
+		claimsJson, _ := encoding.DecodeString(parts[1])
+		json.Unmarshal(headerJson, &header)
+		json.Unmarshal(claimsJson, &claims)
+		if header["alg"] != "ES256" || header["kid"] != "ABC123" || claims["iss"] != "TEAMTOKEN" || claims["iat"] != 1700000000.0 {
+			t.Fatalf("header %s, claims %s", headerJson, claimsJson)
+		}
+		signature, _ := encoding.DecodeString(parts[2])
+		if len(signature) != 64 {
+			t.Fatalf("signature is %d bytes", len(signature))
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			t.Fatal("signature is not valid")
+		}
+	}
+}
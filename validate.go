@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/**
+* 消息校验。所有错误都带上出错字段的路径、违反的规则以及限制值，
+* 以便HTTP接口原样返回给调用方。
+ */
+
+const (
+	RULE_REQUIRED = "required"
+	RULE_TYPE     = "type"
+	RULE_FORMAT   = "format"
+	RULE_SIZE     = "size"
+	RULE_RANGE    = "range"
+	RULE_ENUM     = "enum"
+	RULE_MISMATCH = "mismatch"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+var interruptionLevels = map[string]bool{
+	"passive": true, "active": true, "time-sensitive": true, "critical": true,
+}
+
+type ValidationError struct {
+	Field   string `json:"field,omitempty"` // 出错字段的路径，如aps.alert
+	Rule    string `json:"rule,omitempty"`  // 违反的规则，如size、type
+	Limit   int    `json:"limit,omitempty"` // 规则的限制值，如payload的最大字节数
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (errs *ValidationErrors) add(field string, rule string, limit int, format string, args ...interface{}) {
+	*errs = append(*errs, &ValidationError{field, rule, limit, fmt.Sprintf(format, args...)})
+}
+
+/**
+合并另一个校验结果，prefix不为空时加到字段路径前面。
+*/
+func (errs *ValidationErrors) merge(err error, prefix string) {
+	if err == nil {
+		return
+	}
+	others, ok := err.(ValidationErrors)
+	if !ok {
+		errs.add(prefix, RULE_FORMAT, 0, "%s", err)
+		return
+	}
+	for _, e := range others {
+		if len(prefix) != 0 {
+			e.Field = strings.TrimSuffix(prefix+"."+e.Field, ".")
+		}
+		*errs = append(*errs, e)
+	}
+}
+
+/**
+没有错误时返回nil，避免把空的ValidationErrors当成error返回。
+*/
+func (errs ValidationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+/**
+把json解码的类型错误转换成校验错误，已经是校验错误时（如alert、sound字典）加上prefix。
+*/
+func validationErrorFromJson(err error, prefix string) error {
+	if others, ok := err.(ValidationErrors); ok {
+		var errs ValidationErrors
+		errs.merge(others, prefix)
+		return errs
+	}
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		var errs ValidationErrors
+		errs.add(prefix+"."+typeErr.Field, RULE_TYPE, 0, "expect %s but got %s", typeErr.Type, typeErr.Value)
+		return errs
+	}
+	var errs ValidationErrors
+	errs.add(prefix, RULE_FORMAT, 0, "%s", err)
+	return errs
+}
+
+/**
+payload的大小上限：二进制通道为2048字节，HTTP/2通道为4096字节，VoIP推送为5120字节。
+*/
+func payloadSizeLimit(transport string, pushType string) int {
+	if transport == TRANSPORT_BINARY {
+		return BINARY_PAYLOAD_MAX_SIZE
+	}
+	if pushType == PUSH_TYPE_VOIP {
+		return VOIP_PAYLOAD_MAX_SIZE
+	}
+	return PAYLOAD_MAX_SIZE
+}
+
+/**
+校验payload，pushType决定内容要求，大小限制还取决于应用的通道transport。
+*/
+func (payload *Payload) Validate(pushType string, transport string) error {
+	var errs ValidationErrors
+	if payload.Aps == nil {
+		errs.add("aps", RULE_REQUIRED, 0, "aps is required")
+		return errs
+	}
+	aps := payload.Aps
+
+	switch alert := aps.Alert.(type) {
+	case nil, string:
+	case AlertObject:
+		if alert.SummaryArgCount < 0 {
+			errs.add("aps.alert.summary-arg-count", RULE_RANGE, 0, "should not be negative")
+		}
+	default:
+		errs.add("aps.alert", RULE_TYPE, 0, "alert should be a string or a dictionary")
+	}
+
+	switch sound := aps.Sound.(type) {
+	case nil, string:
+	case SoundObject:
+		if sound.Critical != 0 && sound.Critical != 1 {
+			errs.add("aps.sound.critical", RULE_ENUM, 0, "critical should be 0 or 1")
+		}
+		if sound.Volume < 0 || sound.Volume > 1 {
+			errs.add("aps.sound.volume", RULE_RANGE, 1, "volume should between 0 and 1")
+		}
+	default:
+		errs.add("aps.sound", RULE_TYPE, 0, "sound should be a string or a dictionary")
+	}
+
+	if aps.ContentAvailable != 0 && aps.ContentAvailable != 1 {
+		errs.add("aps.content-available", RULE_ENUM, 0, "content-available should be 0 or 1")
+	}
+	if aps.MutableContent != 0 && aps.MutableContent != 1 {
+		errs.add("aps.mutable-content", RULE_ENUM, 0, "mutable-content should be 0 or 1")
+	}
+	if aps.Badge != nil && *aps.Badge < 0 {
+		errs.add("aps.badge", RULE_RANGE, 0, "badge should not be negative")
+	}
+	if len(aps.InterruptionLevel) != 0 && !interruptionLevels[aps.InterruptionLevel] {
+		errs.add("aps.interruption-level", RULE_ENUM, 0, "unknown interruption level %s", aps.InterruptionLevel)
+	}
+	if aps.RelevanceScore < 0 || aps.RelevanceScore > 1 {
+		errs.add("aps.relevance-score", RULE_RANGE, 1, "relevance-score should between 0 and 1")
+	}
+
+	// 推送类型与内容是否相符
+	switch pushType {
+	case PUSH_TYPE_ALERT:
+		if aps.alertIsEmpty() && aps.Badge == nil && aps.soundIsEmpty() {
+			errs.add("aps", RULE_MISMATCH, 0, "alert push requires alert, badge or sound")
+		}
+	case PUSH_TYPE_BACKGROUND:
+		if aps.ContentAvailable != 1 {
+			errs.add("aps.content-available", RULE_MISMATCH, 0, "background push requires content-available 1")
+		}
+		if !aps.alertIsEmpty() || aps.Badge != nil || !aps.soundIsEmpty() {
+			errs.add("aps", RULE_MISMATCH, 0, "background push should not contain alert, badge or sound")
+		}
+	case PUSH_TYPE_LIVEACTIVITY:
+		if !aps.IsLiveActivity() {
+			errs.add("aps", RULE_MISMATCH, 0, "liveactivity push requires live activity content")
+		}
+	default:
+		if aps.IsLiveActivity() {
+			errs.add("aps", RULE_MISMATCH, 0, "live activity payload can not be sent as %s push", pushType)
+		}
+	}
+	if aps.IsLiveActivity() {
+		errs.merge(aps.ValidateLiveActivity(), "")
+	}
+
+	// 字段路径相对于payload，空字符串表示整个payload
+	data, err := payload.rawJson()
+	if err != nil {
+		errs.add("", RULE_FORMAT, 0, "%s", err)
+	} else if limit := payloadSizeLimit(transport, pushType); len(data) > limit {
+		errs.add("", RULE_SIZE, limit, "payload is %d bytes, exceeds %d bytes", len(data), limit)
+	}
+	return errs.err()
+}
+
+/**
+设备token为偶数长度的十六进制字符串，目前为64个字符。
+*/
+func validateToken(token string) *ValidationError {
+	if len(token) == 0 {
+		return &ValidationError{"token", RULE_REQUIRED, 0, "token is required"}
+	}
+	if len(token) < TOKEN_MIN_LENGTH || len(token) > TOKEN_MAX_LENGTH {
+		return &ValidationError{"token", RULE_FORMAT, TOKEN_MIN_LENGTH,
+			fmt.Sprintf("token should be %d to %d hex characters", TOKEN_MIN_LENGTH, TOKEN_MAX_LENGTH)}
+	}
+	if _, err := hex.DecodeString(token); err != nil {
+		return &ValidationError{"token", RULE_FORMAT, 0, "token should be hex encoded"}
+	}
+	return nil
+}
+
+/**
+token一律以小写保存及查询，与feedback服务返回的token一致。接收token的地方都要先转换。
+*/
+func normalizeToken(token string) string {
+	return strings.ToLower(token)
+}
+
+/**
+校验发给某个应用的token，二进制通道只支持32字节的token。
+*/
+func validateTokenForApp(app string, token string) *ValidationError {
+	if err := validateToken(token); err != nil {
+		return err
+	}
+	if len(token) != BINARY_TOKEN_LENGTH && appTransport(app) == TRANSPORT_BINARY {
+		return &ValidationError{"token", RULE_FORMAT, BINARY_TOKEN_LENGTH,
+			fmt.Sprintf("token should be %d hex characters for binary transport", BINARY_TOKEN_LENGTH)}
+	}
+	return nil
+}
+
+/**
+校验消息的参数及payload，不包括token。同一请求的多个token共享这些内容，只需校验一次。
+*/
+func (notification *Notification) validateMessage() error {
+	var errs ValidationErrors
+	if len(notification.PushType) != 0 {
+		if _, ok := PUSH_TYPE_TOPIC_SUFFIX[notification.PushType]; !ok {
+			errs.add("push_type", RULE_ENUM, 0, "unknown push type %s", notification.PushType)
+		}
+	}
+	switch notification.Priority {
+	case 0, 1, APNS_PRIORITY_POWER_SAVING, APNS_PRIORITY_IMMEDIATELY:
+	default:
+		errs.add("priority", RULE_ENUM, 0, "priority should be 1, 5 or 10")
+	}
+	if notification.PushType == PUSH_TYPE_BACKGROUND && notification.PriorityValue() == APNS_PRIORITY_IMMEDIATELY {
+		errs.add("priority", RULE_MISMATCH, APNS_PRIORITY_POWER_SAVING, "background push should use priority 5")
+	}
+	if len(notification.CollapseID) > COLLAPSE_ID_MAX_SIZE {
+		errs.add("collapse_id", RULE_SIZE, COLLAPSE_ID_MAX_SIZE, "collapse_id exceeds %d bytes", COLLAPSE_ID_MAX_SIZE)
+	}
+	if len(notification.ApnsID) != 0 && !uuidPattern.MatchString(notification.ApnsID) {
+		errs.add("apns_id", RULE_FORMAT, 0, "apns_id should be a UUID")
+	}
+	if notification.PushType == PUSH_TYPE_LIVEACTIVITY && appTransport(notification.App) == TRANSPORT_BINARY {
+		errs.add("push_type", RULE_MISMATCH, 0, "live activity can only be sent through http2")
+	}
+
+	if notification.Payload == nil {
+		errs.add("payload", RULE_REQUIRED, 0, "payload is required")
+	} else {
+		errs.merge(notification.Payload.Validate(notification.PushType, appTransport(notification.App)), "payload")
+	}
+	return errs.err()
+}
+
+func (notification *Notification) Validate() error {
+	var errs ValidationErrors
+	if err := validateTokenForApp(notification.App, notification.Token); err != nil {
+		errs = append(errs, err)
+	}
+	errs.merge(notification.validateMessage(), "")
+	return errs.err()
+}
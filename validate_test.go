@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+/**
+在临时的AppsDir下建立应用目录，options为app.json的内容，为空时不写app.json。
+*/
+func setupAppsDir(t *testing.T, apps map[string]string) {
+	dir, err := ioutil.TempDir("", "goapns-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	appConfig.AppsDir = dir
+	for app, options := range apps {
+		if err := os.MkdirAll(path.Join(dir, app, PRODUCTION_FOLDER), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if len(options) == 0 {
+			continue
+		}
+		if err := ioutil.WriteFile(path.Join(dir, app, APP_OPTIONS_FILE_NAME), []byte(options), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidateForBinaryTransport(t *testing.T) {
+	appConfig = NewConfig()
+	setupAppsDir(t, map[string]string{"com.binary": "", "com.http2": `{"Transport": "http2"}`})
+	longToken := strings.Repeat("a", 100)
+	live := &Payload{Aps: &AlertInfo{Timestamp: 1700000000, Event: LIVE_ACTIVITY_EVENT_END}}
+
+	for _, c := range []struct {
+		app     string
+		message Notification
+		field   string
+	}{
+		{"com.binary", Notification{Token: longToken, Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}, "token"},
+		{"com.binary", Notification{Token: strings.Repeat("a", 64), Payload: live, PushType: PUSH_TYPE_LIVEACTIVITY}, "push_type"},
+		{"com.http2", Notification{Token: longToken, Payload: &Payload{Aps: &AlertInfo{Alert: "hi"}}}, ""},
+		{"com.http2", Notification{Token: strings.Repeat("a", 64), Payload: live, PushType: PUSH_TYPE_LIVEACTIVITY}, ""},
+		// 二进制通道的payload最大2048字节，HTTP/2为4096字节
+		{"com.binary", Notification{Token: strings.Repeat("a", 64), Payload: &Payload{Aps: &AlertInfo{Alert: strings.Repeat("a", 3000)}}}, "payload"},
+		{"com.http2", Notification{Token: strings.Repeat("a", 64), Payload: &Payload{Aps: &AlertInfo{Alert: strings.Repeat("a", 3000)}}}, ""},
+	} {
+		c.message.App = c.app
+		err := c.message.Validate()
+		if len(c.field) == 0 {
+			if err != nil {
+				t.Errorf("%s %s: unexpected error %s", c.app, c.message.PushType, err)
+			}
+			continue
+		}
+		errs, _ := err.(ValidationErrors)
+		if len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("%s %s: got %v, want error on %s", c.app, c.message.PushType, err, c.field)
+		}
+	}
+
+	// 扫描后使用记下的通道，不再读取app.json
+	apps, err := scanApps()
+	if err != nil || apps["com.http2"] == nil || apps["com.http2"].Transport != TRANSPORT_HTTP2 {
+		t.Fatalf("scanned %+v, %v", apps, err)
+	}
+	knownAppsMutex.Lock()
+	knownApps = apps
+	knownAppsMutex.Unlock()
+	defer func() {
+		knownAppsMutex.Lock()
+		knownApps = nil
+		knownAppsMutex.Unlock()
+	}()
+	os.Remove(path.Join(appConfig.AppsDir, "com.http2", APP_OPTIONS_FILE_NAME))
+	if transport := appTransport("com.http2"); transport != TRANSPORT_HTTP2 {
+		t.Errorf("transport is %s before reload", transport)
+	}
+}
+
+func TestBadgeZero(t *testing.T) {
+	payload, err := MakePayloadFromString(`{"aps": {"badge": 0}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := payload.Validate(PUSH_TYPE_ALERT, TRANSPORT_HTTP2); err != nil {
+		t.Fatalf("badge 0 is not a valid alert push: %s", err)
+	}
+	data, _ := payload.Json()
+	if !strings.Contains(string(data), `"badge":0`) {
+		t.Fatalf("badge 0 is not sent: %s", data)
+	}
+	payload, _ = MakePayloadFromString(`{"aps": {"alert": "hi"}}`)
+	if data, _ := payload.Json(); strings.Contains(string(data), "badge") {
+		t.Fatalf("badge is sent without being set: %s", data)
+	}
+}
+
+func TestNestedTypeErrorPath(t *testing.T) {
+	for _, c := range []struct {
+		payload string
+		field   string
+	}{
+		{`{"aps": {"badge": "1"}}`, "payload.aps.badge"},
+		{`{"aps": {"alert": {"loc-args": "a"}}}`, "payload.aps.alert.loc-args"},
+		{`{"aps": {"sound": {"volume": "loud"}}}`, "payload.aps.sound.volume"},
+	} {
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(c.payload), &payload); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := MakeNotificationTemplate(map[string]interface{}{"payload": payload}, "com.a")
+		errs, _ := err.(ValidationErrors)
+		if len(errs) != 1 || errs[0].Field != c.field || errs[0].Rule != RULE_TYPE {
+			t.Errorf("%s: got %v, want type error on %s", c.payload, err, c.field)
+		}
+	}
+}
+
+func TestPayloadValidate(t *testing.T) {
+	long := strings.Repeat("a", PAYLOAD_MAX_SIZE)
+	for _, c := range []struct {
+		pushType string
+		payload  string
+		field    string // 出错的字段，空字符串表示没有错误
+		rule     string
+	}{
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi"}}`, "", ""},
+		{PUSH_TYPE_ALERT, `{"aps": {"sound": {"name": "a.aiff", "volume": 0.5}}}`, "", ""},
+		{PUSH_TYPE_ALERT, `{"aps": {}, "custom": 1}`, "aps", RULE_MISMATCH},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi", "badge": -1}}`, "aps.badge", RULE_RANGE},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi", "sound": {"volume": 2}}}`, "aps.sound.volume", RULE_RANGE},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi", "interruption-level": "loud"}}`, "aps.interruption-level", RULE_ENUM},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi", "relevance-score": 2}}`, "aps.relevance-score", RULE_RANGE},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "hi", "content-available": 2}}`, "aps.content-available", RULE_ENUM},
+		{PUSH_TYPE_ALERT, `{"aps": {"alert": "` + long + `"}}`, "", RULE_SIZE},
+		{PUSH_TYPE_VOIP, `{"aps": {"alert": "` + long + `"}}`, "", ""},
+		{PUSH_TYPE_BACKGROUND, `{"aps": {"content-available": 1}}`, "", ""},
+		{PUSH_TYPE_BACKGROUND, `{"aps": {}}`, "aps.content-available", RULE_MISMATCH},
+		{PUSH_TYPE_BACKGROUND, `{"aps": {"content-available": 1, "badge": 0}}`, "aps", RULE_MISMATCH},
+		{PUSH_TYPE_LIVEACTIVITY, `{"aps": {"alert": "hi"}}`, "aps", RULE_MISMATCH},
+	} {
+		payload, err := MakePayloadFromString(c.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = payload.Validate(c.pushType, TRANSPORT_HTTP2)
+		if len(c.rule) == 0 {
+			if err != nil {
+				t.Errorf("%s %s: unexpected error %s", c.pushType, c.payload, err)
+			}
+			continue
+		}
+		errs, _ := err.(ValidationErrors)
+		if len(errs) != 1 || errs[0].Field != c.field || errs[0].Rule != c.rule {
+			t.Errorf("%s %s: got %v, want %s error on %q", c.pushType, c.payload, err, c.rule, c.field)
+		}
+	}
+}
+
+func TestNotificationValidate(t *testing.T) {
+	appConfig = NewConfig()
+	setupAppsDir(t, map[string]string{"com.http2": `{"Transport": "http2"}`})
+	token := strings.Repeat("a", 64)
+	alert := &Payload{Aps: &AlertInfo{Alert: "hi"}}
+	background := &Payload{Aps: &AlertInfo{ContentAvailable: 1}}
+
+	for _, c := range []struct {
+		message Notification
+		field   string
+	}{
+		{Notification{Token: token, Payload: alert, ApnsID: NewUUID(), CollapseID: "news"}, ""},
+		{Notification{Token: strings.Repeat("a", 160), Payload: alert}, ""},
+		{Notification{Token: token, Payload: background, PushType: PUSH_TYPE_BACKGROUND, Priority: APNS_PRIORITY_POWER_SAVING}, ""},
+		{Notification{Payload: alert}, "token"},
+		{Notification{Token: strings.Repeat("z", 64), Payload: alert}, "token"},
+		{Notification{Token: token}, "payload"},
+		{Notification{Token: token, Payload: &Payload{Aps: &AlertInfo{}}, PushType: PUSH_TYPE_ALERT}, "payload.aps"},
+		{Notification{Token: token, Payload: alert, PushType: "fax"}, "push_type"},
+		{Notification{Token: token, Payload: alert, Priority: 3}, "priority"},
+		{Notification{Token: token, Payload: background, PushType: PUSH_TYPE_BACKGROUND}, "priority"},
+		{Notification{Token: token, Payload: alert, ApnsID: "1234"}, "apns_id"},
+		{Notification{Token: token, Payload: alert, CollapseID: strings.Repeat("c", COLLAPSE_ID_MAX_SIZE+1)}, "collapse_id"},
+	} {
+		c.message.App = "com.http2"
+		err := c.message.Validate()
+		if len(c.field) == 0 {
+			if err != nil {
+				t.Errorf("%+v: unexpected error %s", c.message, err)
+			}
+			continue
+		}
+		errs, _ := err.(ValidationErrors)
+		if len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("%+v: got %v, want error on %s", c.message, err, c.field)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* 投递结果回调。每个应用可以在app.json中配置多个webhook，
+* 回调先写入数据库中的待发队列（WH:前缀），再由后台任务发送，失败时按指数退避重试，
+* 服务重启后未发送的回调会继续发送。到期的回调由WEBHOOK_WORKERS个goroutine同时发送，
+* 每个请求最多等待WEBHOOK_TIMEOUT，一个很慢的回调地址不会耽误其他回调。
+* 回调的body用webhook的Secret做HMAC-SHA256签名，放在X-Goapns-Signature头中。
+ */
+
+const (
+	WEBHOOK_EVENT_REJECTED           = "rejected"
+	WEBHOOK_EVENT_INVALID_TOKEN      = "invalid_token"
+	WEBHOOK_EVENT_CONNECTION_FAILURE = "connection_failure"
+	WEBHOOK_EVENT_TEST               = "test"
+
+	WEBHOOK_OUTBOX_PREFIX = "WH:"
+	WEBHOOK_MAX_ATTEMPTS  = 10
+	WEBHOOK_RETRY_BASE    = 5 * time.Second
+	WEBHOOK_RETRY_MAX     = time.Hour
+	WEBHOOK_POLL_INTERVAL = time.Second
+	WEBHOOK_CLAIM_PREFIX  = "WH-lock:"
+	WEBHOOK_CLAIM_TTL     = time.Minute // 大于一次发送的超时时间
+	WEBHOOK_TIMEOUT       = 10 * time.Second
+	WEBHOOK_WORKERS       = 4
+
+	WEBHOOK_SIGNATURE_HEADER = "X-Goapns-Signature"
+	WEBHOOK_EVENT_HEADER     = "X-Goapns-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-Goapns-Delivery"
+)
+
+var webhookClient = &http.Client{}
+
+type WebhookConfig struct {
+	URL    string
+	Secret string
+	Events []string `json:",omitempty"` // 要接收的事件，为空时接收所有事件
+}
+
+func (webhook *WebhookConfig) accept(event string) bool {
+	if len(webhook.Events) == 0 || event == WEBHOOK_EVENT_TEST {
+		return true
+	}
+	for _, e := range webhook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+* 待发队列中的一次回调。Secret不存到数据库，发送时再从应用配置中读取。
+ */
+type WebhookDelivery struct {
+	ID          string
+	App         string
+	URL         string
+	Event       string
+	Body        []byte
+	Attempts    int
+	NextAttempt int64 // unix时间戳，纳秒
+}
+
+/**
+为应用所有订阅了该事件的webhook生成回调，写入待发队列。返回生成的回调数。
+*/
+func FireWebhook(app string, event string, data map[string]interface{}) int {
+	bundle := strings.Replace(app, DEVELOP_SUBFIX, "", 1)
+	webhooks := loadAppOptions(bundle).Webhooks
+	if len(webhooks) == 0 {
+		return 0
+	}
+
+	body := map[string]interface{}{
+		"event":   event,
+		"app":     bundle,
+		"sandbox": strings.HasSuffix(app, DEVELOP_SUBFIX),
+		"time":    time.Now().Unix(),
+	}
+	for k, v := range data {
+		body[k] = v
+	}
+	content, err := json.Marshal(body)
+	if err != nil {
+		log.Println("can not encode webhook event", err)
+		return 0
+	}
+
+	count := 0
+	for _, webhook := range webhooks {
+		if !webhook.accept(event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:          NewUUID(),
+			App:         bundle,
+			URL:         webhook.URL,
+			Event:       event,
+			Body:        content,
+			NextAttempt: time.Now().UnixNano(),
+		}
+		delivery.save()
+		count++
+	}
+	return count
+}
+
+/**
+消息被苹果拒绝或无法发送时的回调，token失效时另外发一个invalid_token事件。
+*/
+func fireRejectedWebhook(notification *Notification, apnsStatus int, reason string, invalidToken bool) {
+	if notification == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"message_id":  notification.ApnsID,
+		"token":       notification.Token,
+		"apns_status": apnsStatus,
+		"reason":      reason,
+	}
+	FireWebhook(notification.App, WEBHOOK_EVENT_REJECTED, data)
+	if invalidToken {
+		FireWebhook(notification.App, WEBHOOK_EVENT_INVALID_TOKEN, map[string]interface{}{
+			"token": notification.Token, "reason": reason})
+	}
+}
+
+func (delivery *WebhookDelivery) key() string {
+	return fmt.Sprintf("%s%s", WEBHOOK_OUTBOX_PREFIX, delivery.ID)
+}
+
+func (delivery *WebhookDelivery) save() {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println("can not encode webhook delivery", err)
+		return
+	}
+	putRecord(delivery.key(), data)
+}
+
+func (delivery *WebhookDelivery) secret() (string, bool) {
+	for _, webhook := range loadAppOptions(delivery.App).Webhooks {
+		if webhook.URL == delivery.URL {
+			return webhook.Secret, true
+		}
+	}
+	return "", false
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (delivery *WebhookDelivery) send() error {
+	secret, ok := delivery.secret()
+	if !ok {
+		return fmt.Errorf("webhook %s is no longer configured for %s", delivery.URL, delivery.App)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event)
+	request.Header.Set(WEBHOOK_DELIVERY_HEADER, delivery.ID)
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(secret, delivery.Body))
+
+	rsp, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded %d", delivery.URL, rsp.StatusCode)
+	}
+	return nil
+}
+
+/**
+发送一次回调，失败时安排下次重试，超过最大次数后丢弃。
+*/
+func (delivery *WebhookDelivery) attempt() {
+	err := delivery.send()
+	if err == nil {
+		deleteRecord(delivery.key())
+		return
+	}
+
+	delivery.Attempts++
+	if delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		log.Printf("drop webhook %s %s after %d attempts: %s", delivery.Event, delivery.URL, delivery.Attempts, err)
+		deleteRecord(delivery.key())
+		return
+	}
+	backoff := WEBHOOK_RETRY_BASE << uint(delivery.Attempts-1)
+	if backoff > WEBHOOK_RETRY_MAX {
+		backoff = WEBHOOK_RETRY_MAX
+	}
+	log.Printf("webhook %s %s failed: %s, retry in %s", delivery.Event, delivery.URL, err, backoff)
+	delivery.NextAttempt = time.Now().Add(backoff).UnixNano()
+	delivery.save()
+}
+
+func StartWebhookService() {
+	defer CapturePanic("Webhook service occur runtime error!")
+	tick := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+
+	for {
+		select {
+		case _ = <-tick.C:
+			runWebhookJob()
+		}
+	}
+}
+
+func runWebhookJob() {
+	now := time.Now().UnixNano()
+	var due []*WebhookDelivery
+	scanRecords(WEBHOOK_OUTBOX_PREFIX, func(key string, value []byte) bool {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			log.Println("invalid webhook delivery", key, err)
+			return true
+		}
+		if delivery.NextAttempt <= now {
+			due = append(due, &delivery)
+		}
+		return true
+	})
+	if len(due) == 0 {
+		return
+	}
+
+	// 等所有回调发完再返回，下一次扫描不会与这一次重叠
+	queue := make(chan *WebhookDelivery)
+	var wg sync.WaitGroup
+	for i := 0; i < WEBHOOK_WORKERS && i < len(due); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer CapturePanic("webhook worker stopped")
+			for delivery := range queue {
+				deliverWebhook(delivery, now)
+			}
+		}()
+	}
+	for _, delivery := range due {
+		queue <- delivery
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func deliverWebhook(delivery *WebhookDelivery, now int64) {
+	// 多个实例共用Redis时，每个回调只由占用成功的实例发送
+	if !claimRecord(WEBHOOK_CLAIM_PREFIX+delivery.ID, WEBHOOK_CLAIM_TTL) {
+		return
+	}
+	// 占用前可能已被其他实例发送或改期
+	var current WebhookDelivery
+	data := getRecord(delivery.key())
+	if len(data) == 0 || json.Unmarshal(data, &current) != nil || current.NextAttempt > now {
+		return
+	}
+	current.attempt()
+}
+
+/**
+POST /v2/apps/<app>/webhooks/test：给应用的所有webhook发一个test事件。
+*/
+func webhookTestHandler(w http.ResponseWriter, request *http.Request, app string) {
+	if request.Method != "POST" {
+		writeApiError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+	if len(loadAppOptions(app).Webhooks) == 0 {
+		writeApiError(w, http.StatusNotFound, "no webhook configured for "+app)
+		return
+	}
+	count := FireWebhook(app, WEBHOOK_EVENT_TEST, map[string]interface{}{
+		"message_id": NewUUID(),
+		"token":      strings.Repeat("0", TOKEN_MIN_LENGTH),
+		"reason":     "this is a test event",
+	})
+	writeJson(w, http.StatusOK, map[string]interface{}{"queued": count})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveredOnceByConcurrentWorkers(t *testing.T) {
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if signature := r.Header.Get(WEBHOOK_SIGNATURE_HEADER); signature != signWebhook("s", body) {
+			t.Errorf("signature of %s is %s", body, signature)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer srv.Close()
+	appConfig = NewConfig()
+	setupAppsDir(t, map[string]string{"com.a": `{"Webhooks": [{"URL": "` + srv.URL + `", "Secret": "s"}]}`})
+	store = NewMemoryStore()
+	defer closeStore()
+
+	if n := FireWebhook("com.a", WEBHOOK_EVENT_REJECTED, map[string]interface{}{"token": "t"}); n != 1 {
+		t.Fatalf("%d deliveries queued", n)
+	}
+	// 多个实例共用同一个待发队列
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWebhookJob()
+		}()
+	}
+	wg.Wait()
+	if posts != 1 {
+		t.Fatalf("webhook is posted %d times", posts)
+	}
+	remaining := 0
+	scanRecords(WEBHOOK_OUTBOX_PREFIX, func(key string, value []byte) bool {
+		remaining++
+		return true
+	})
+	if remaining != 0 {
+		t.Fatalf("%d deliveries left in outbox", remaining)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// RFC 4231 test case 2
+	want := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := signWebhook("Jefe", []byte("what do ya want for nothing?")); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestSlowWebhookDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	var posts int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+	}))
+	defer fast.Close()
+	appConfig = NewConfig()
+	setupAppsDir(t, map[string]string{
+		"com.slow": `{"Webhooks": [{"URL": "` + slow.URL + `", "Secret": "s"}]}`,
+		"com.fast": `{"Webhooks": [{"URL": "` + fast.URL + `", "Secret": "s"}]}`,
+	})
+	store = NewMemoryStore()
+	defer closeStore()
+
+	FireWebhook("com.slow", WEBHOOK_EVENT_REJECTED, map[string]interface{}{"token": "t"})
+	FireWebhook("com.fast", WEBHOOK_EVENT_REJECTED, map[string]interface{}{"token": "t"})
+	done := make(chan struct{})
+	go func() {
+		runWebhookJob()
+		close(done)
+	}()
+	waitFor(t, "fast webhook", func() bool { return atomic.LoadInt32(&posts) == 1 })
+	select {
+	case <-done:
+		t.Fatal("job finished while the slow webhook is still pending")
+	default:
+	}
+	release <- struct{}{}
+	<-done
+}